@@ -3,8 +3,10 @@ module github.com/Kaijlo/OpaGO/wasmProject
 go 1.18
 
 require (
+	github.com/bytecodealliance/wasmtime-go v0.36.0
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/open-policy-agent/opa v0.41.0
-	github.com/tetratelabs/wazero v0.0.0-20220615025247-3068d17c7731
+	github.com/tetratelabs/wazero v1.2.1
 )
 
 require (
@@ -20,5 +22,6 @@ require (
 	github.com/xeipuuv/gojsonpointer v0.0.0-20190905194746-02993c407bfb // indirect
 	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	github.com/yashtewari/glob-intersection v0.1.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
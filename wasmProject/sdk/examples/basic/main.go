@@ -49,25 +49,13 @@ func main() {
 
 	ctx := context.Background()
 
-	eps, err := rego.Entrypoints(ctx)
+	result, err := rego.Eval(ctx, opa.EvalOpts{EntrypointName: "example/allow", Input: &input})
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
 
-	entrypointID, ok := eps["example/allow"]
-	if !ok {
-		fmt.Println("error: Unable to find entrypoint 'example/allow'")
-		return
-	}
-
-	result, err := rego.Eval(ctx, opa.EvalOpts{Entrypoint: entrypointID, Input: &input})
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		return
-	}
-
-	fmt.Printf("Policy 1 result: %v\n", result)
+	fmt.Printf("Policy 1 result: %s\n", result.Result)
 
 	// Update the policy on the fly.
 
@@ -77,31 +65,19 @@ func main() {
 		return
 	}
 
-	// Get an updated entrypoint ID, they may have changed!
-	eps, err = rego.Entrypoints(ctx)
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		return
-	}
-
-	entrypointID, ok = eps["example/allow"]
-	if !ok {
-		fmt.Println("error: Unable to find entrypoint 'example/allow'")
-		return
-	}
-
-	// Evaluate the new policy.
+	// Evaluate the new policy. The entrypoint IDs may have changed, the
+	// name is resolved against the new policy.
 
 	if err := rego.SetPolicy(ctx, policy); err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
 
-	result, err = rego.Eval(ctx, opa.EvalOpts{Entrypoint: entrypointID, Input: &input})
+	result, err = rego.Eval(ctx, opa.EvalOpts{EntrypointName: "example/allow", Input: &input})
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Policy 2 result: %v\n", result)
+	fmt.Printf("Policy 2 result: %s\n", result.Result)
 }
@@ -51,25 +51,15 @@ func main() {
 
 	ctx := context.Background()
 
-	eps, err := rego.Entrypoints(ctx)
+	// The loader may swap the policy at any time; the entrypoint name
+	// is resolved against the policy actually evaluated.
+	result, err := rego.Eval(ctx, opa.EvalOpts{EntrypointName: "example/allow", Input: &input})
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
 
-	entrypointID, ok := eps["example/allow"]
-	if !ok {
-		fmt.Println("error: Unable to find entrypoint 'example/allow'")
-		return
-	}
-
-	result, err := rego.Eval(ctx, opa.EvalOpts{Entrypoint: entrypointID, Input: &input})
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		return
-	}
-
-	fmt.Printf("Policy result: %v\n", result)
+	fmt.Printf("Policy result: %s\n", result.Result)
 }
 
 func setup(u string, token string) error {
@@ -0,0 +1,241 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+// Package persist keeps the bundles activated by a loader on disk, for
+// the loader to activate them again on its next start.
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotPrefix = "bundle-"
+	tagFile        = "tag"
+	deltaPrefix    = "delta-"
+	bundleSuffix   = ".tar.gz"
+
+	// MaxDeltas is the maximum number of delta bundles saved on top of
+	// a snapshot bundle.
+	MaxDeltas = 64
+)
+
+// ErrTooManyDeltas is returned by SaveDelta once MaxDeltas delta bundles
+// are saved: a snapshot bundle is to be saved instead.
+var ErrTooManyDeltas = errors.New("too many delta bundles")
+
+// Dir is a directory holding the snapshot bundle activated last, and the
+// delta bundles applied on top of it since, in order. A directory is to
+// be used by a single loader.
+//
+// The snapshots are numbered, the deltas with the number of their
+// snapshot: saving a snapshot is complete once renamed in place, the
+// previous snapshot and its deltas then dropped. If interrupted in
+// between, the leftovers are ignored, and dropped by the next snapshot.
+type Dir string
+
+// SaveSnapshot saves a snapshot bundle, replacing the bundles saved.
+func (d Dir) SaveSnapshot(raw []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+
+	if err := d.dropTag(); err != nil {
+		return err
+	}
+
+	names, err := d.list(snapshotPrefix)
+	if err != nil {
+		return err
+	}
+
+	seq := 0
+	if len(names) > 0 {
+		seq = sequence(names[len(names)-1], snapshotPrefix) + 1
+	}
+
+	if err := d.write(snapshotName(seq), raw); err != nil {
+		return err
+	}
+
+	// Drop the previous snapshots and all the deltas, none being of the
+	// new snapshot yet.
+	deltas, err := d.list(deltaPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(names, deltas...) {
+		if err := os.Remove(filepath.Join(string(d), name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveDelta saves a delta bundle, applied on top of the bundles saved.
+// It returns ErrTooManyDeltas instead once MaxDeltas are saved, the
+// bundles saved remaining, yet outdated.
+func (d Dir) SaveDelta(raw []byte) error {
+	if err := d.dropTag(); err != nil {
+		return err
+	}
+
+	seq, deltas, err := d.current()
+	if err != nil {
+		return err
+	} else if seq < 0 {
+		return fmt.Errorf("no snapshot bundle saved")
+	} else if len(deltas) >= MaxDeltas {
+		return ErrTooManyDeltas
+	}
+
+	return d.write(deltaName(seq, len(deltas)), raw)
+}
+
+// SaveTag saves the tag of the bundles saved, identifying them to their
+// origin, e.g. an ETag. Saving a bundle drops the tag, for it to be
+// saved again once the bundle is.
+func (d Dir) SaveTag(tag string) error {
+	return d.write(tagFile, []byte(tag))
+}
+
+// Tag returns the tag of the bundles saved, empty if not saved.
+func (d Dir) Tag() (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(string(d), tagFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(raw), err
+}
+
+// dropTag removes the tag saved, if any.
+func (d Dir) dropTag() error {
+	if err := os.Remove(filepath.Join(string(d), tagFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Load returns the snapshot bundle saved, and the delta bundles to
+// apply on top of it, in order. If no snapshot is saved, it returns a
+// nil snapshot.
+func (d Dir) Load() ([]byte, [][]byte, error) {
+	seq, names, err := d.current()
+	if err != nil {
+		return nil, nil, err
+	} else if seq < 0 {
+		return nil, nil, nil
+	}
+
+	snapshot, err := ioutil.ReadFile(filepath.Join(string(d), snapshotName(seq)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deltas := make([][]byte, len(names))
+	for i, name := range names {
+		if deltas[i], err = ioutil.ReadFile(filepath.Join(string(d), name)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return snapshot, deltas, nil
+}
+
+// current returns the number of the snapshot saved last, -1 if none,
+// and the names of its deltas, in order.
+func (d Dir) current() (int, []string, error) {
+	snapshots, err := d.list(snapshotPrefix)
+	if err != nil || len(snapshots) == 0 {
+		return -1, nil, err
+	}
+
+	seq := sequence(snapshots[len(snapshots)-1], snapshotPrefix)
+	deltas, err := d.list(fmt.Sprintf("%s%08d-", deltaPrefix, seq))
+	if err != nil {
+		return -1, nil, err
+	}
+
+	return seq, deltas, nil
+}
+
+// list returns the names of the bundles saved with the prefix given, in
+// order.
+func (d Dir) list(prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, prefix) && strings.HasSuffix(name, bundleSuffix) {
+			names = append(names, name)
+		}
+	}
+
+	// Zero padded, the numbers sort as the names.
+	sort.Strings(names)
+	return names, nil
+}
+
+// snapshotName returns the file name of the snapshot numbered seq.
+func snapshotName(seq int) string {
+	return fmt.Sprintf("%s%08d%s", snapshotPrefix, seq, bundleSuffix)
+}
+
+// deltaName returns the file name of the i'th delta of the snapshot
+// numbered seq.
+func deltaName(seq int, i int) string {
+	return fmt.Sprintf("%s%08d-%08d%s", deltaPrefix, seq, i, bundleSuffix)
+}
+
+// sequence returns the number of the bundle file name given.
+func sequence(name string, prefix string) int {
+	seq, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), bundleSuffix))
+	return seq
+}
+
+// write writes a file atomically, through a temporary file renamed.
+func (d Dir) write(name string, raw []byte) error {
+	f, err := ioutil.TempFile(string(d), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(string(d), name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
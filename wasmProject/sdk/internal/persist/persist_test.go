@@ -0,0 +1,142 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDirSaveLoad(t *testing.T) {
+	d := testDir(t)
+
+	if snapshot, _, err := d.Load(); snapshot != nil || err != nil {
+		t.Fatalf("expected no snapshot, got %q, %v", snapshot, err)
+	}
+
+	if err := d.SaveDelta([]byte("delta")); err == nil {
+		t.Fatal("expected a delta without a snapshot to fail")
+	}
+
+	mustSave(t, d.SaveSnapshot, "snapshot-1")
+	mustSave(t, d.SaveDelta, "delta-1")
+	mustSave(t, d.SaveDelta, "delta-2")
+	checkLoad(t, d, "snapshot-1", "delta-1", "delta-2")
+
+	// A snapshot replaces the bundles saved.
+	mustSave(t, d.SaveSnapshot, "snapshot-2")
+	mustSave(t, d.SaveDelta, "delta-3")
+	checkLoad(t, d, "snapshot-2", "delta-3")
+	checkFiles(t, d, snapshotName(1), deltaName(1, 0))
+}
+
+func TestDirSaveSnapshotInterrupted(t *testing.T) {
+	d := testDir(t)
+
+	mustSave(t, d.SaveSnapshot, "snapshot-1")
+	mustSave(t, d.SaveDelta, "delta-1")
+
+	// Interrupted once the next snapshot renamed in place: the previous
+	// snapshot and its deltas are left over.
+	if err := d.write(snapshotName(1), []byte("snapshot-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkLoad(t, d, "snapshot-2")
+
+	mustSave(t, d.SaveDelta, "delta-2")
+	checkLoad(t, d, "snapshot-2", "delta-2")
+
+	// Dropped by the next snapshot.
+	mustSave(t, d.SaveSnapshot, "snapshot-3")
+	checkLoad(t, d, "snapshot-3")
+	checkFiles(t, d, snapshotName(2))
+}
+
+func TestDirMaxDeltas(t *testing.T) {
+	d := testDir(t)
+
+	mustSave(t, d.SaveSnapshot, "snapshot")
+	for i := 0; i < MaxDeltas; i++ {
+		mustSave(t, d.SaveDelta, "delta")
+	}
+
+	if err := d.SaveTag("tag"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.SaveDelta([]byte("delta")); err != ErrTooManyDeltas {
+		t.Fatalf("expected too many deltas, got %v", err)
+	}
+
+	// The tag no longer identifies the bundles saved.
+	if tag, err := d.Tag(); tag != "" || err != nil {
+		t.Fatalf("expected the tag dropped, got %q, %v", tag, err)
+	}
+
+	if _, deltas, err := d.Load(); len(deltas) != MaxDeltas || err != nil {
+		t.Fatalf("expected %d deltas, got %d, %v", MaxDeltas, len(deltas), err)
+	}
+}
+
+func testDir(t *testing.T) Dir {
+	dir, err := ioutil.TempDir("", "test-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return Dir(dir)
+}
+
+func mustSave(t *testing.T, save func([]byte) error, raw string) {
+	t.Helper()
+	if err := save([]byte(raw)); err != nil {
+		t.Fatalf("unable to save %s: %v", raw, err)
+	}
+}
+
+func checkLoad(t *testing.T, d Dir, snapshot string, deltas ...string) {
+	t.Helper()
+
+	s, ds, err := d.Load()
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if string(s) != snapshot {
+		t.Fatalf("expected snapshot %q, got %q", snapshot, s)
+	}
+
+	got := make([]string, 0, len(ds))
+	for _, delta := range ds {
+		got = append(got, string(delta))
+	}
+
+	if expected := append([]string{}, deltas...); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected deltas %q, got %q", expected, got)
+	}
+}
+
+func checkFiles(t *testing.T, d Dir, names ...string) {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(string(d), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, match := range matches {
+		got = append(got, filepath.Base(match))
+	}
+
+	if !reflect.DeepEqual(got, names) {
+		t.Fatalf("expected the files %q, got %q", names, got)
+	}
+}
@@ -7,26 +7,32 @@ import (
 	"fmt"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/metrics"
+	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/topdown/print"
-	"github.com/tetratelabs/wazero"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
 type vmOpts struct {
 	policy         []byte
+	compiled       Compiled
 	data           []byte
 	parsedData     []byte
 	parsedDataAddr int32
 	memoryMin      uint32
 	memoryMax      uint32
+	strict         bool
+	builtins       map[string]topdown.BuiltinFunc
+	revision       uint64 // Data revision of the data, or parsed data.
 }
 type VM struct {
-	runtime              *wazero.Runtime
+	engine               Engine
 	ctx                  context.Context
-	module               Module
+	module               *Module
 	policy               []byte
+	compiled             Compiled
 	memoryMin            int
 	memoryMax            int
 	abiMajorVersion      int32
@@ -53,20 +59,42 @@ type VM struct {
 	free                 func(context.Context, int32) error
 	valueAddPath         func(context.Context, int32, int32, int32) (int32, error)
 	valueRemovePath      func(context.Context, int32, int32) (int32, error)
+	strictBuiltinErrors  bool                           // Builtin errors fail the evaluation, instead of being undefined.
+	builtins             map[string]topdown.BuiltinFunc // Custom builtins, by name.
+	dirty                uint32                         // Set once an exported call failed, the instance must not be reused.
+	evals                uint32                         // Evaluations since instantiated.
+	generation           uint64                         // Generation of the pool policy and data the VM is of.
+	revision             uint64                         // Data revision of the pool the VM is of.
 }
 
-func newVM(opts vmOpts, runtime *wazero.Runtime) (*VM, error) {
+// newVM instantiates a VM from the policy module already compiled by
+// the engine. The compiled module is shared, only the instance (and its
+// memory) is private to the VM.
+func newVM(opts vmOpts, engine Engine) (*VM, error) {
 	vm := VM{}
 	vm.ctx = context.Background()
-	vm.runtime = runtime
+	vm.engine = engine
 	vm.policy = opts.policy
+	vm.compiled = opts.compiled
 	vm.memoryMin = int(opts.memoryMin)
 	vm.memoryMax = int(opts.memoryMax)
-	modOpts := moduleOpts{policy: opts.policy, ctx: vm.ctx, minMemSize: int(opts.memoryMin), maxMemSize: int(opts.memoryMax), vm: &vm}
-	vm.module = newModule(modOpts, *runtime)
-	vm.abiMajorVersion = vm.module.wasm_abi_version()
-	vm.abiMinorVersion = vm.module.wasm_abi_minor_version()
-	vm.entrypointIDs = vm.GetEntrypoints()
+	vm.strictBuiltinErrors = opts.strict
+	vm.builtins = opts.builtins
+	vm.revision = opts.revision
+	modOpts := moduleOpts{compiled: opts.compiled, ctx: vm.ctx, minMemSize: int(opts.memoryMin), maxMemSize: int(opts.memoryMax), vm: &vm}
+	var err error
+	if vm.module, err = newModule(modOpts, engine); err != nil {
+		return nil, err
+	}
+	if vm.abiMajorVersion, err = vm.module.wasm_abi_version(); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	if vm.abiMinorVersion, err = vm.module.wasm_abi_minor_version(); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	vm.entrypointIDs = vm.module.entrypointT
 	vm.dataAddr = opts.parsedDataAddr
 	vm.evalOneOff = vm.module.opa_eval
 	vm.eval = vm.module.eval
@@ -85,21 +113,24 @@ func newVM(opts vmOpts, runtime *wazero.Runtime) (*VM, error) {
 	vm.free = vm.module.free
 	vm.valueAddPath = vm.module.value_add_path
 	vm.valueRemovePath = vm.module.value_remove_path
-	vm.setData(opts, vm.ctx, "newVM")
+	if err := vm.setData(opts, vm.ctx, "newVM"); err != nil {
+		vm.Close()
+		return nil, err
+	}
 	return &vm, nil
 }
 func (i *VM) SetPolicyData(ctx context.Context, opts vmOpts) error {
 
 	if !bytes.Equal(opts.policy, i.policy) {
 		// Swap the instance to a new one, with new policy.
-		i.module.module.Close(i.ctx)
-		i.module.env.Close(i.ctx)
-		n, err := newVM(opts, i.runtime)
+		i.Close()
+		n, err := newVM(opts, i.engine)
 		if err != nil {
 			return err
 		}
 
 		*i = *n
+		i.module.vm = i
 		return nil
 	}
 
@@ -144,6 +175,12 @@ func (v *VM) setData(opts vmOpts, ctx context.Context, path string) error {
 	return nil
 }
 
+// Close releases the module instances of the VM. The compiled policy
+// module is owned by the pool and left intact.
+func (i *VM) Close() {
+	i.module.Close()
+}
+
 // Println is invoked if the policy WASM code calls opa_println().
 func (i *VM) Println(arg int32) {
 	data := i.module.readFrom(arg)
@@ -254,7 +291,11 @@ func (i *VM) toRegoJSON(ctx context.Context, v interface{}, free bool) (int32, e
 	}
 
 	n := int32(len(raw))
-	p := int32(i.module.writeMem(raw))
+	loc, err := i.module.writeMem(raw)
+	if err != nil {
+		return 0, err
+	}
+	p := int32(loc)
 
 	addr, err := i.valueParse(ctx, p, n)
 	if err != nil {
@@ -270,10 +311,8 @@ func (i *VM) toRegoJSON(ctx context.Context, v interface{}, free bool) (int32, e
 	return addr, nil
 }
 
-//
-//Parses the json data, writes it to the shared memory buffer and updates the baseHeapPtr and evalHeapPtr values accordingly
-//Is used when setting the policy data
-//
+// Parses the json data, writes it to the shared memory buffer and updates the baseHeapPtr and evalHeapPtr values accordingly
+// Is used when setting the policy data
 func (i *VM) toDRegoJSON(ctx context.Context, v interface{}, free bool) error {
 	var raw []byte
 	switch v := v.(type) {
@@ -292,7 +331,11 @@ func (i *VM) toDRegoJSON(ctx context.Context, v interface{}, free bool) error {
 	}
 
 	n := int32(len(raw))
-	p := int32(i.module.writeMem(raw))
+	loc, err := i.module.writeMem(raw)
+	if err != nil {
+		return err
+	}
+	p := int32(loc)
 	i.dataLen = int32(n)
 	addr, err := i.valueParse(ctx, p, n)
 	if err != nil {
@@ -320,14 +363,33 @@ func (i *VM) setHeapState(ctx context.Context, ptr int32) error {
 	return i.heapPtrSet(ctx, ptr)
 }
 
-//copies the parsed data to optimize cloning VMs
+// copies the parsed data to optimize cloning VMs
 func (vm *VM) cloneDataSegment() (int32, []byte) {
-	srcData := vm.module.readFrom(0)[vm.baseHeapPtr:vm.evalHeapPtr]
-	patchedData := make([]byte, len(srcData))
-	copy(patchedData, srcData)
-	return vm.dataAddr, patchedData
+	srcData := vm.module.readMem(uint32(vm.baseHeapPtr), uint32(vm.evalHeapPtr-vm.baseHeapPtr))
+	return vm.dataAddr, copyBytes(srcData)
+}
+
+// DataRevision returns the data revision of the pool the VM data is of.
+func (vm *VM) DataRevision() uint64 {
+	return vm.revision
+}
+
+// memorySize returns the size of the VM memory, in bytes.
+func (vm *VM) memorySize() uint32 {
+	return vm.module.instance.Memory().Size(vm.ctx)
+}
+
+// setDirty marks the VM to be replaced instead of reused. An abandoned
+// evaluation may set it concurrently to the pool reading it.
+func (vm *VM) setDirty() {
+	atomic.StoreUint32(&vm.dirty, 1)
+}
+
+// Dirty returns true if the VM state is undefined after a failed call.
+func (vm *VM) Dirty() bool {
+	return atomic.LoadUint32(&vm.dirty) == 1
 }
-func (vm *VM) GetEntrypoints() map[string]int32 {
+func (vm *VM) GetEntrypoints() (map[string]int32, error) {
 	return vm.module.GetEntrypoints()
 }
 func (i *VM) Eval(ctx context.Context,
@@ -339,6 +401,7 @@ func (i *VM) Eval(ctx context.Context,
 	iqbCache cache.InterQueryCache,
 	ph print.Hook,
 	capabilities *ast.Capabilities) ([]byte, error) {
+	i.evals++
 	if i.abiMinorVersion < int32(2) {
 		return i.evalCompat(ctx, entrypoint, input, metrics, seed, ns, iqbCache, ph, capabilities)
 	}
@@ -380,9 +443,9 @@ func (i *VM) Eval(ctx context.Context,
 	}
 
 	// Setting the ctx here ensures that it'll be available to builtins that
-	// make use of it (e.g. `http.send`); and it will spawn a go routine
-	// cancelling the builtins that use topdown.Cancel, when the context is
-	// cancelled.
+	// make use of it (e.g. `http.send`); and every builtin call will spawn
+	// a go routine cancelling the builtins that use topdown.Cancel, when
+	// the context is cancelled.
 	i.module.Reset(ctx, seed, ns, iqbCache, ph, capabilities)
 
 	metrics.Timer("wasm_vm_eval_call").Start()
@@ -392,13 +455,9 @@ func (i *VM) Eval(ctx context.Context,
 	}
 	metrics.Timer("wasm_vm_eval_call").Stop()
 
-	data := i.module.readUntil(resultAddr, 0b0)
-	dataC := make([]byte, len(data)-2)
-	copy(dataC, data[1:len(data)-1])
-	retVals := []byte{byte(123)}
-	retVals = append(retVals, dataC...)
-	retVals = append(retVals, byte(125))
-	return retVals, nil
+	// The result set is serialized as a JSON array, one object of
+	// bindings per result. It is returned as is; the caller parses it.
+	return i.module.readUntil(resultAddr, 0b0), nil
 }
 func (i *VM) evalCompat(ctx context.Context,
 	entrypoint int32,
@@ -415,9 +474,9 @@ func (i *VM) evalCompat(ctx context.Context,
 	metrics.Timer("wasm_vm_eval_prepare_input").Start()
 
 	// Setting the ctx here ensures that it'll be available to builtins that
-	// make use of it (e.g. `http.send`); and it will spawn a go routine
-	// cancelling the builtins that use topdown.Cancel, when the context is
-	// cancelled.
+	// make use of it (e.g. `http.send`); and every builtin call will spawn
+	// a go routine cancelling the builtins that use topdown.Cancel, when
+	// the context is cancelled.
 	i.module.Reset(ctx, seed, ns, iqbCache, ph, capabilities)
 
 	err := i.setHeapState(ctx, i.evalHeapPtr)
@@ -467,7 +526,9 @@ func (i *VM) evalCompat(ctx context.Context,
 		return nil, err
 	}
 
-	serialized, err := i.valueDump(ctx, resultAddr)
+	// Dump as JSON, not as a Rego value, to serialize the result set
+	// the same way as opa_eval does.
+	serialized, err := i.jsonDump(ctx, resultAddr)
 	if err != nil {
 		return nil, err
 	}
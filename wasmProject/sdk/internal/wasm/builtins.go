@@ -1,66 +1,60 @@
 package wasm
 
 import (
+	"encoding/json"
 	"fmt"
 
-	"strconv"
-
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/topdown"
 )
 
-func newBuiltinTable(mod Module) map[int32]topdown.BuiltinFunc {
-	builtinStrAddr := mod.builtins(mod.ctx)
+// newBuiltinTable resolves the builtins the policy imports, by name, to
+// their implementations, the custom builtins of the VM first. A policy
+// requiring a builtin not implemented, or taking more arguments than
+// the ABI dispatches, is rejected as invalid.
+func newBuiltinTable(mod *Module) (map[int32]topdown.BuiltinFunc, error) {
+	builtinStrAddr, err := mod.builtins(mod.ctx)
+	if err != nil {
+		return nil, err
+	}
 	builtinsJSON, err := mod.json_dump(mod.ctx, (builtinStrAddr))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	builtinStr := mod.readStr(uint32(builtinsJSON))
-	builtinNameMap := parseJsonString(builtinStr)
-	builtinIdMap, err := getFuncs(builtinNameMap)
+	builtinNameMap, err := parseIDs(mod.readStr(uint32(builtinsJSON)))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return builtinIdMap
+	var custom map[string]topdown.BuiltinFunc
+	if mod.vm != nil {
+		custom = mod.vm.builtins
+	}
+	return getFuncs(builtinNameMap, custom)
 }
-func parseJsonString(str string) map[string]int32 {
-	currKey := ""
-	inKey := false
-	inVal := false
-	currVal := ""
-	out := map[string]int32{}
-	for _, char := range str {
-		switch char {
-		case '"':
-			inKey = !inKey
-		case '{':
-		case '}':
-			val, _ := strconv.ParseInt(currVal, 10, 32)
-			out[currKey] = int32(val)
-		case ':':
-			inVal = true
-		case ',':
-			val, _ := strconv.ParseInt(currVal, 10, 32)
-			out[currKey] = int32(val)
-			inVal = false
-			currVal = ""
-			currKey = ""
-		default:
-			if inKey {
-				currKey += string(char)
-			} else if inVal {
-				currVal += string(char)
-			}
-		}
 
+// parseIDs parses the name to ID mapping the policy exports for its
+// builtins and entrypoints.
+func parseIDs(str string) (map[string]int32, error) {
+	out := map[string]int32{}
+	if err := json.Unmarshal([]byte(str), &out); err != nil {
+		return nil, errors.New(errors.InvalidPolicyOrDataErr, err.Error())
 	}
-	return out
+	return out, nil
 }
-func getFuncs(ids map[string]int32) (map[int32]topdown.BuiltinFunc, error) {
+func getFuncs(ids map[string]int32, custom map[string]topdown.BuiltinFunc) (map[int32]topdown.BuiltinFunc, error) {
 	out := map[int32]topdown.BuiltinFunc{}
 	for name, id := range ids {
+		if f, ok := custom[name]; ok {
+			out[id] = f
+			continue
+		}
 		out[id] = topdown.GetBuiltin(name)
-		if out[id] == nil && name != "" {
-			return out, fmt.Errorf("no function named %s", name)
+		if out[id] == nil {
+			return nil, errors.New(errors.InvalidPolicyOrDataErr, fmt.Sprintf("unsupported builtin: %s", name))
+		}
+		if b, ok := ast.BuiltinMap[name]; ok && len(b.Decl.FuncArgs().Args) > MaxBuiltinArgs {
+			return nil, errors.New(errors.InvalidPolicyOrDataErr, fmt.Sprintf("unsupported builtin: %s: more than %d arguments", name, MaxBuiltinArgs))
 		}
 	}
 	return out, nil
@@ -0,0 +1,106 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Engine compiles policy modules for the VMs of a pool. The compiled
+// code is shared, the VMs only instantiate it.
+type Engine interface {
+	// Compile compiles the policy module, to be instantiated by VMs.
+	Compile(ctx context.Context, policy []byte) (Compiled, error)
+
+	// Close releases the engine and everything compiled by it.
+	Close(ctx context.Context) error
+}
+
+// Compiled is a policy module compiled by an Engine.
+type Compiled interface {
+	// Instantiate instantiates the module with its "env" imports bound to
+	// the functions given, and a memory of the given limits, in pages. A
+	// zero maximum means the memory is not limited.
+	Instantiate(ctx context.Context, imports Imports, minPages, maxPages uint32) (Instance, error)
+
+	// Close releases the compiled code. The instances are left intact.
+	Close(ctx context.Context) error
+}
+
+// MaxBuiltinArgs is the maximum number of arguments of the builtins a
+// policy calls: the OPA Wasm ABI dispatches them through opa_builtin0
+// to opa_builtin4 only, and OPA does not compile calls with more.
+const MaxBuiltinArgs = 4
+
+// Imports are the host functions the OPA Wasm ABI requires.
+type Imports struct {
+	Abort   func(addr int32)                         // opa_abort
+	Builtin func(id, ctx int32, args ...int32) int32 // opa_builtin0..4
+	Println func(addr int32)                         // opa_println
+}
+
+// Instance is an instance of a policy module, with its memory.
+type Instance interface {
+	// Call invokes the exported function. A panic of an import unwinds
+	// the call and is returned as an error. The instance stops running
+	// the wasm code once ctx is done, returning errInterrupted; it is
+	// not to be called anymore then, nor if the engine preempted the
+	// call, returning errPreempted.
+	Call(ctx context.Context, name string, params ...uint64) ([]uint64, error)
+
+	// Global returns the value of the exported global.
+	Global(ctx context.Context, name string) (uint64, error)
+
+	// Memory returns the memory the module imports.
+	Memory() Memory
+
+	// Close releases the instance.
+	Close(ctx context.Context) error
+}
+
+// Memory is the linear memory of an instance. The slices read are views
+// of the memory, valid until the next call into wasm.
+type Memory interface {
+	Size(ctx context.Context) uint32
+	Grow(ctx context.Context, deltaPages uint32) (previousPages uint32, ok bool)
+	Read(ctx context.Context, offset, byteCount uint32) ([]byte, bool)
+	Write(ctx context.Context, offset uint32, v []byte) bool
+}
+
+// errInterrupted is returned by the calls of instances stopped as their
+// ctx got done.
+var errInterrupted = errors.New("interrupted")
+
+// errPreempted is returned by the calls of instances stopped as the ctx
+// of another call got done, their ctx not done.
+var errPreempted = errors.New("preempted")
+
+// DefaultEngine is the name of the engine pools use unless configured
+// otherwise.
+const DefaultEngine = "wazero"
+
+// engines are the constructors of the engines available, by name. The
+// wasmtime engine registers itself if built with the wasmtime tag.
+var engines = map[string]func() Engine{
+	DefaultEngine: newWazeroEngine,
+}
+
+// Engines returns the names of the engines available, sorted.
+func Engines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEngine constructs the engine of the given name.
+func NewEngine(name string) (Engine, error) {
+	f, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q, available: %v", name, Engines())
+	}
+	return f(), nil
+}
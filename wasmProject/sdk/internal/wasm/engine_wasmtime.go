@@ -0,0 +1,279 @@
+//go:build wasmtime
+// +build wasmtime
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+func init() {
+	engines["wasmtime"] = newWasmtimeEngine
+}
+
+// wasmtimeEngine runs the policies with wasmtime, on a single engine.
+// Its instances are interrupted through epochs once the ctx of a call is
+// done. The epoch is shared by all the stores of the engine: the calls
+// not interruptible run with a deadline out of reach, while the ones
+// running meanwhile with a ctx not done are preempted too, returning
+// errPreempted.
+type wasmtimeEngine struct {
+	engine *wasmtime.Engine
+}
+
+func newWasmtimeEngine() Engine {
+	cfg := wasmtime.NewConfig()
+	cfg.SetEpochInterruption(true)
+	return &wasmtimeEngine{engine: wasmtime.NewEngineWithConfig(cfg)}
+}
+
+func (e *wasmtimeEngine) Compile(ctx context.Context, policy []byte) (Compiled, error) {
+	module, err := wasmtime.NewModule(e.engine, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmtimeCompiled{engine: e.engine, module: module}, nil
+}
+
+// Close is a no-op, wasmtime releases its resources once unreachable.
+func (e *wasmtimeEngine) Close(ctx context.Context) error {
+	return nil
+}
+
+type wasmtimeCompiled struct {
+	engine *wasmtime.Engine
+	module *wasmtime.Module
+}
+
+// Instantiate instantiates the policy in a store of its own, so every
+// instance gets a private memory and builtin bindings.
+func (c *wasmtimeCompiled) Instantiate(ctx context.Context, imports Imports, minPages, maxPages uint32) (Instance, error) {
+	// The code run by the instantiation is not interruptible.
+	store := wasmtime.NewStore(c.engine)
+	store.SetEpochDeadline(epochUnreachable)
+	memory, err := wasmtime.NewMemory(store, wasmtime.NewMemoryType(minPages, maxPages != 0, maxPages))
+	if err != nil {
+		return nil, err
+	}
+
+	i := &wasmtimeInstance{engine: c.engine, store: store, bindings: &wasmtimeBindings{imports: imports}}
+	i.memory = &wasmtimeMemory{instance: i, memory: memory}
+
+	b := i.bindings
+	i32 := wasmtime.NewValType(wasmtime.KindI32)
+	builtin := func(args []wasmtime.Val) []wasmtime.Val {
+		operands := make([]int32, len(args)-2)
+		for j := range operands {
+			operands[j] = args[j+2].I32()
+		}
+		return []wasmtime.Val{wasmtime.ValI32(b.imports.Builtin(args[0].I32(), args[1].I32(), operands...))}
+	}
+
+	externs := map[string]wasmtime.AsExtern{
+		"opa_abort": b.newFunc(store, []*wasmtime.ValType{i32}, nil, func(args []wasmtime.Val) []wasmtime.Val {
+			b.imports.Abort(args[0].I32())
+			return nil
+		}),
+		"opa_println": b.newFunc(store, []*wasmtime.ValType{i32}, nil, func(args []wasmtime.Val) []wasmtime.Val {
+			b.imports.Println(args[0].I32())
+			return nil
+		}),
+		"memory": memory,
+	}
+	// The builtin dispatchers take the builtin ID, a reserved context and
+	// up to four arguments.
+	for n := 0; n <= 4; n++ {
+		params := make([]*wasmtime.ValType, n+2)
+		for j := range params {
+			params[j] = i32
+		}
+		externs[fmt.Sprintf("opa_builtin%d", n)] = b.newFunc(store, params, []*wasmtime.ValType{i32}, builtin)
+	}
+
+	linker := wasmtime.NewLinker(c.engine)
+	for name, extern := range externs {
+		if err := linker.Define("env", name, extern); err != nil {
+			i.Close(ctx)
+			return nil, fmt.Errorf("linker: env.%s: %w", name, err)
+		}
+	}
+
+	if i.instance, err = linker.Instantiate(store, c.module); err != nil {
+		i.Close(ctx)
+		return nil, err
+	}
+	return i, nil
+}
+
+// Close is a no-op, the module is released once unreachable.
+func (c *wasmtimeCompiled) Close(ctx context.Context) error {
+	return nil
+}
+
+// epochUnreachable is the epoch deadline of the calls not interruptible,
+// relative to the current epoch: only incremented to interrupt, it is
+// not to reach it.
+const epochUnreachable = math.MaxUint32
+
+type wasmtimeInstance struct {
+	engine   *wasmtime.Engine
+	store    *wasmtime.Store
+	instance *wasmtime.Instance
+	memory   *wasmtimeMemory
+	bindings *wasmtimeBindings
+}
+
+// wasmtimeBindings are the imports of an instance, as its host functions
+// see them. wasmtime-go holds the host functions of the stores live in a
+// global map, which must not reach the store through them: the store
+// would never be released.
+type wasmtimeBindings struct {
+	imports Imports
+	caller  *wasmtime.Caller // Set while an import runs, the store is borrowed by it.
+}
+
+// newFunc wraps an import, making the caller the store to use while it
+// runs.
+func (b *wasmtimeBindings) newFunc(store *wasmtime.Store, params, results []*wasmtime.ValType, f func([]wasmtime.Val) []wasmtime.Val) *wasmtime.Func {
+	return wasmtime.NewFunc(store, wasmtime.NewFuncType(params, results), func(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+		prev := b.caller
+		b.caller = caller
+		defer func() { b.caller = prev }()
+		return f(args), nil
+	})
+}
+
+func (i *wasmtimeInstance) storelike() wasmtime.Storelike {
+	if caller := i.bindings.caller; caller != nil {
+		return caller
+	}
+	return i.store
+}
+
+// Call invokes the exported function, interrupting it once ctx is done.
+// wasmtime re-panics the panics of the imports after unwinding the wasm
+// stack, they are recovered here.
+func (i *wasmtimeInstance) Call(ctx context.Context, name string, params ...uint64) (ret []uint64, err error) {
+	f := i.instance.GetFunc(i.storelike(), name)
+	if f == nil {
+		return nil, fmt.Errorf("no exported function %q", name)
+	}
+
+	args := make([]interface{}, len(params))
+	for j, p := range params {
+		args[j] = int32(uint32(p))
+	}
+
+	// Calls made by imports run within the outermost one, already
+	// bridging its ctx to the epoch.
+	if i.bindings.caller == nil {
+		if ctx.Done() == nil {
+			i.store.SetEpochDeadline(epochUnreachable)
+		} else {
+			i.store.SetEpochDeadline(1)
+			done, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				select {
+				case <-ctx.Done():
+					i.engine.IncrementEpoch()
+				case <-done:
+				}
+			}()
+			// Wait for the goroutine, not to interrupt a later call.
+			defer func() {
+				close(done)
+				<-stopped
+			}()
+		}
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			ret, err = nil, fmt.Errorf("%s: %v", name, e)
+		}
+	}()
+
+	v, err := f.Call(i.storelike(), args...)
+	if err != nil {
+		var t *wasmtime.Trap
+		if errors.As(err, &t) && strings.Contains(t.Message(), "epoch deadline") {
+			if ctx.Err() == nil {
+				return nil, errPreempted
+			}
+			return nil, errInterrupted
+		}
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case int32:
+		return []uint64{uint64(uint32(v))}, nil
+	default:
+		return nil, fmt.Errorf("%s: unexpected results: %v", name, v)
+	}
+}
+
+func (i *wasmtimeInstance) Global(ctx context.Context, name string) (uint64, error) {
+	export := i.instance.GetExport(i.storelike(), name)
+	if export == nil || export.Global() == nil {
+		return 0, fmt.Errorf("no exported global %q", name)
+	}
+	val := export.Global().Get(i.storelike())
+	if val.Kind() != wasmtime.KindI32 {
+		return 0, fmt.Errorf("global %q: not an i32", name)
+	}
+	return uint64(uint32(val.I32())), nil
+}
+
+func (i *wasmtimeInstance) Memory() Memory {
+	return i.memory
+}
+
+// Close releases the store. wasmtime-go has no explicit release of the
+// stores: they are deleted once unreachable, the bindings left to its
+// host functions cleared for them not to reach the instance anymore.
+func (i *wasmtimeInstance) Close(ctx context.Context) error {
+	i.bindings.imports, i.bindings.caller = Imports{}, nil
+	i.store, i.instance, i.memory = nil, nil, nil
+	return nil
+}
+
+type wasmtimeMemory struct {
+	instance *wasmtimeInstance
+	memory   *wasmtime.Memory
+}
+
+func (m *wasmtimeMemory) Size(ctx context.Context) uint32 {
+	return uint32(m.memory.DataSize(m.instance.storelike()))
+}
+
+func (m *wasmtimeMemory) Grow(ctx context.Context, deltaPages uint32) (uint32, bool) {
+	prev, err := m.memory.Grow(m.instance.storelike(), uint64(deltaPages))
+	return uint32(prev), err == nil
+}
+
+func (m *wasmtimeMemory) Read(ctx context.Context, offset, byteCount uint32) ([]byte, bool) {
+	data := m.memory.UnsafeData(m.instance.storelike())
+	if uint64(offset)+uint64(byteCount) > uint64(len(data)) {
+		return nil, false
+	}
+	return data[offset : offset+byteCount], true
+}
+
+func (m *wasmtimeMemory) Write(ctx context.Context, offset uint32, v []byte) bool {
+	data := m.memory.UnsafeData(m.instance.storelike())
+	if uint64(offset)+uint64(len(v)) > uint64(len(data)) {
+		return false
+	}
+	copy(data[offset:], v)
+	return true
+}
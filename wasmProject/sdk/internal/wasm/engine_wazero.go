@@ -0,0 +1,447 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wazeroEngine runs the policies with wazero, in a single runtime. The
+// policies import their memory and host functions from the "env"
+// module, which a runtime can hold once only: the policies are compiled
+// defining their memory instead, and the host functions of the "env"
+// module dispatch to the imports of the calling instance, carried by
+// the ctx. The runtime closes the instances running wasm code once the
+// ctx of a call is done.
+type wazeroEngine struct {
+	runtime wazero.Runtime
+	env     error // Set if the "env" module failed to instantiate.
+}
+
+func newWazeroEngine() Engine {
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+
+	_, err := r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, addr int32) {
+		callerImports(ctx).Abort(addr)
+	}).Export("opa_abort").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, addr int32) {
+		callerImports(ctx).Println(addr)
+	}).Export("opa_println").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, id, bctx int32) int32 {
+		return callerImports(ctx).Builtin(id, bctx)
+	}).Export("opa_builtin0").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, id, bctx, a1 int32) int32 {
+		return callerImports(ctx).Builtin(id, bctx, a1)
+	}).Export("opa_builtin1").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, id, bctx, a1, a2 int32) int32 {
+		return callerImports(ctx).Builtin(id, bctx, a1, a2)
+	}).Export("opa_builtin2").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, id, bctx, a1, a2, a3 int32) int32 {
+		return callerImports(ctx).Builtin(id, bctx, a1, a2, a3)
+	}).Export("opa_builtin3").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, id, bctx, a1, a2, a3, a4 int32) int32 {
+		return callerImports(ctx).Builtin(id, bctx, a1, a2, a3, a4)
+	}).Export("opa_builtin4").
+		Instantiate(ctx)
+
+	return &wazeroEngine{runtime: r, env: err}
+}
+
+// importsKey is the ctx key of the imports of the instance calling.
+type importsKey struct{}
+
+// callerImports returns the imports of the instance calling, as put in
+// the ctx by wazeroInstance.
+func callerImports(ctx context.Context) *Imports {
+	imports, ok := ctx.Value(importsKey{}).(*Imports)
+	if !ok {
+		panic("wasm: host function called without the imports of the instance")
+	}
+	return imports
+}
+
+func (e *wazeroEngine) Compile(ctx context.Context, policy []byte) (Compiled, error) {
+	if e.env != nil {
+		return nil, e.env
+	}
+
+	m, err := parseMemoryImport(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &wazeroCompiled{engine: e, module: m, compiled: make(map[uint32]wazeroLimits)}
+
+	// Compile the unlimited memory variant, to report the errors now.
+	if _, err := c.compile(ctx, m.minPages, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (e *wazeroEngine) Close(ctx context.Context) error {
+	return e.runtime.Close(ctx)
+}
+
+// wazeroCompiled is a policy compiled, once per memory limits
+// instantiated with, the limits being part of the module. The policy
+// allocator sizes its heap by the initial memory, hence the memory is
+// not grown after instantiation instead: a pool instantiates with the
+// same limits until its data outgrows the minimum.
+type wazeroCompiled struct {
+	engine   *wazeroEngine
+	module   memoryImport
+	mutex    sync.Mutex
+	compiled map[uint32]wazeroLimits // By maximum pages, 0 if unlimited.
+}
+
+// wazeroLimits is the policy compiled with a minimum memory size.
+type wazeroLimits struct {
+	minPages uint32
+	compiled wazero.CompiledModule
+}
+
+// compile returns the policy compiled with the memory limits given. The
+// policy compiled with another minimum for the maximum is closed, its
+// instances left intact.
+func (c *wazeroCompiled) compile(ctx context.Context, minPages, maxPages uint32) (wazero.CompiledModule, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if l, ok := c.compiled[maxPages]; ok && l.minPages == minPages {
+		return l.compiled, nil
+	}
+
+	compiled, err := c.engine.runtime.CompileModule(ctx, c.module.define(minPages, maxPages))
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := c.compiled[maxPages]; ok {
+		l.compiled.Close(ctx)
+	}
+
+	c.compiled[maxPages] = wazeroLimits{minPages: minPages, compiled: compiled}
+	return compiled, nil
+}
+
+// Instantiate instantiates the policy anonymously.
+func (c *wazeroCompiled) Instantiate(ctx context.Context, imports Imports, minPages, maxPages uint32) (Instance, error) {
+	if minPages < c.module.minPages {
+		minPages = c.module.minPages
+	}
+	if maxPages >= maxWasmPages {
+		maxPages = 0
+	}
+
+	compiled, err := c.compile(ctx, minPages, maxPages)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &wazeroInstance{imports: imports}
+	module, err := c.engine.runtime.InstantiateModule(i.context(ctx), compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, err
+	}
+
+	i.module, i.memory = module, wazeroMemory{module.Memory()}
+	return i, nil
+}
+
+// Close releases the compiled code. The instances are left intact.
+func (c *wazeroCompiled) Close(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var err error
+	for _, l := range c.compiled {
+		if e := l.compiled.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	c.compiled = nil
+	return err
+}
+
+type wazeroInstance struct {
+	imports Imports
+	module  api.Module
+	memory  wazeroMemory
+}
+
+// context returns the ctx for the host functions to find the imports
+// of the instance with.
+func (i *wazeroInstance) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, importsKey{}, &i.imports)
+}
+
+// Call invokes the exported function. If ctx gets done, the runtime
+// closes the instance, and the call returns errInterrupted.
+func (i *wazeroInstance) Call(ctx context.Context, name string, params ...uint64) ([]uint64, error) {
+	f := i.module.ExportedFunction(name)
+	if f == nil {
+		return nil, fmt.Errorf("no exported function %q", name)
+	}
+
+	ret, err := f.Call(i.context(ctx), params...)
+	if err != nil {
+		var exit *sys.ExitError
+		if errors.As(err, &exit) && (exit.ExitCode() == sys.ExitCodeContextCanceled || exit.ExitCode() == sys.ExitCodeDeadlineExceeded) {
+			return nil, errInterrupted
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (i *wazeroInstance) Global(ctx context.Context, name string) (uint64, error) {
+	g := i.module.ExportedGlobal(name)
+	if g == nil {
+		return 0, fmt.Errorf("no exported global %q", name)
+	}
+	return g.Get(), nil
+}
+
+func (i *wazeroInstance) Memory() Memory {
+	return i.memory
+}
+
+func (i *wazeroInstance) Close(ctx context.Context) error {
+	return i.module.Close(ctx)
+}
+
+// wazeroMemory adapts the memory of wazero, not taking a ctx.
+type wazeroMemory struct {
+	memory api.Memory
+}
+
+func (m wazeroMemory) Size(ctx context.Context) uint32 {
+	return m.memory.Size()
+}
+
+func (m wazeroMemory) Grow(ctx context.Context, deltaPages uint32) (uint32, bool) {
+	return m.memory.Grow(deltaPages)
+}
+
+func (m wazeroMemory) Read(ctx context.Context, offset, byteCount uint32) ([]byte, bool) {
+	return m.memory.Read(offset, byteCount)
+}
+
+func (m wazeroMemory) Write(ctx context.Context, offset uint32, v []byte) bool {
+	return m.memory.Write(offset, v)
+}
+
+// maxWasmPages is the maximum size of a 32-bit wasm memory, in pages.
+const maxWasmPages = 65536
+
+// memoryImport is a policy binary split around its import of the
+// "env" memory, to define the memory instead.
+type memoryImport struct {
+	head     []byte // Sections up to the memory section, the import removed.
+	tail     []byte // Sections after.
+	minPages uint32 // Minimum size of the memory imported.
+}
+
+// define returns the policy binary defining its memory, of the limits
+// given, in pages. A zero maximum means the memory is not limited. The
+// memory index remains 0, the function indices unchanged.
+func (m memoryImport) define(minPages, maxPages uint32) []byte {
+	memory := []byte{0x01} // One memory.
+	if maxPages == 0 {
+		memory = appendU32(append(memory, 0x00), minPages)
+	} else {
+		memory = appendU32(appendU32(append(memory, 0x01), minPages), maxPages)
+	}
+
+	binary := make([]byte, 0, len(m.head)+len(memory)+len(m.tail)+8)
+	binary = append(binary, m.head...)
+	binary = appendSection(binary, 5, memory)
+	return append(binary, m.tail...)
+}
+
+// parseMemoryImport splits the policy binary around its import of the
+// "env" memory, the only memory of the policy.
+func parseMemoryImport(policy []byte) (memoryImport, error) {
+	const header = "\x00asm\x01\x00\x00\x00"
+
+	var m memoryImport
+	if len(policy) < len(header) || string(policy[:len(header)]) != header {
+		return m, fmt.Errorf("invalid wasm binary header")
+	}
+
+	m.head = append(m.head, header...)
+	found := false
+	r := wasmReader{b: policy[len(header):]}
+	for len(r.b) > 0 {
+		start := r.b
+		id := r.byte()
+		content := r.bytes(r.u32())
+		if r.err != nil {
+			return m, r.err
+		}
+		section := start[:len(start)-len(r.b)]
+
+		switch {
+		case id == 5:
+			return m, fmt.Errorf("policy defines a memory")
+		case id == 2:
+			imports, min, ok, err := removeMemoryImport(content)
+			if err != nil {
+				return m, err
+			} else if !ok {
+				return m, fmt.Errorf("policy does not import the env memory")
+			}
+
+			m.head = appendSection(m.head, 2, imports)
+			m.minPages, found = min, true
+		case id <= 4 && len(m.tail) == 0:
+			// The custom sections, the types, functions and tables
+			// precede the memory.
+			m.head = append(m.head, section...)
+		default:
+			m.tail = append(m.tail, section...)
+		}
+	}
+
+	if !found {
+		return m, fmt.Errorf("policy does not import the env memory")
+	}
+	return m, nil
+}
+
+// removeMemoryImport returns the import section without the import of
+// the "env" memory, and the minimum size of the memory imported.
+func removeMemoryImport(section []byte) ([]byte, uint32, bool, error) {
+	r := wasmReader{b: section}
+	n := r.u32()
+
+	var imports []byte
+	var min uint32
+	found := false
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		start := r.b
+		module := string(r.bytes(r.u32()))
+		name := string(r.bytes(r.u32()))
+		switch kind := r.byte(); kind {
+		case 0x00: // Function.
+			r.u32()
+		case 0x01: // Table.
+			r.byte()
+			r.limits()
+		case 0x02: // Memory.
+			if module != "env" || name != "memory" || found {
+				return nil, 0, false, fmt.Errorf("policy imports the memory %s.%s", module, name)
+			}
+			min, _ = r.limits()
+			found = true
+			continue
+		case 0x03: // Global.
+			r.byte()
+			r.byte()
+		default:
+			return nil, 0, false, fmt.Errorf("invalid import kind %#x", kind)
+		}
+		imports = append(imports, start[:len(start)-len(r.b)]...)
+	}
+
+	if r.err != nil {
+		return nil, 0, false, r.err
+	} else if len(r.b) > 0 {
+		return nil, 0, false, fmt.Errorf("invalid import section")
+	}
+
+	if found {
+		n--
+	}
+	return append(appendU32(nil, n), imports...), min, found, nil
+}
+
+// wasmReader decodes a wasm binary, the first error latched.
+type wasmReader struct {
+	b   []byte
+	err error
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil || len(r.b) == 0 {
+		r.fail()
+		return 0
+	}
+
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.fail()
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// u32 decodes an unsigned LEB128 value.
+func (r *wasmReader) u32() uint32 {
+	var v uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		b := r.byte()
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+
+	r.fail()
+	return 0
+}
+
+// limits decodes the limits of a table or memory, the maximum zero if
+// none.
+func (r *wasmReader) limits() (uint32, uint32) {
+	switch flags := r.byte(); flags {
+	case 0x00:
+		return r.u32(), 0
+	case 0x01:
+		return r.u32(), r.u32()
+	default:
+		r.fail()
+		return 0, 0
+	}
+}
+
+func (r *wasmReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("invalid wasm binary")
+	}
+	r.b = nil
+}
+
+func appendSection(b []byte, id byte, content []byte) []byte {
+	b = appendU32(append(b, id), uint32(len(content)))
+	return append(b, content...)
+}
+
+func appendName(b []byte, name string) []byte {
+	return append(appendU32(b, uint32(len(name))), name...)
+}
+
+// appendU32 appends v encoded as unsigned LEB128.
+func appendU32(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
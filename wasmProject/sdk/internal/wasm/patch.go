@@ -0,0 +1,167 @@
+package wasm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+)
+
+// The operations of a data patch.
+const (
+	PatchAdd     = "add"
+	PatchRemove  = "remove"
+	PatchReplace = "replace"
+)
+
+// PatchOp is an operation of a data patch, JSON Patch-style: add sets
+// the value at the path, creating the missing parents; replace sets the
+// value at the path, which must exist; remove removes the value at the
+// path, which must exist.
+type PatchOp struct {
+	Op    string
+	Path  []string
+	Value interface{} // Unused by remove.
+}
+
+// Patch applies the operations in order to the data. The operations
+// are checked against a copy of the data first, hence the data is left
+// as is if any is invalid. Returns ErrInvalidPolicyOrData if an
+// operation is invalid, and ErrInternal if the patching fails.
+func (i *VM) Patch(ctx context.Context, ops []PatchOp) error {
+	doc, err := i.data(ctx)
+	if err != nil {
+		return wrapErr(errors.InternalErr, err)
+	}
+
+	if _, err := ApplyPatch(doc, ops); err != nil {
+		return errors.New(errors.InvalidPolicyOrDataErr, err.Error())
+	}
+
+	for _, op := range ops {
+		if op.Op == PatchRemove {
+			err = i.RemoveDataPath(ctx, op.Path)
+		} else {
+			err = i.SetDataPath(ctx, op.Path, op.Value)
+		}
+
+		if err != nil {
+			return wrapErr(errors.InternalErr, err)
+		}
+	}
+
+	return nil
+}
+
+// ApplyPatch applies the operations in order to the JSON document, and
+// returns the document patched. The objects on the paths are copied,
+// the document given being left as is.
+func ApplyPatch(doc interface{}, ops []PatchOp) (interface{}, error) {
+	for n, op := range ops {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d: %s /%s: %v", n, op.Op, strings.Join(op.Path, "/"), err)
+		}
+	}
+	return doc, nil
+}
+
+// data returns the data, dumped as JSON. The memory of the dump is
+// reclaimed, the data not referring to it.
+func (i *VM) data(ctx context.Context) (interface{}, error) {
+	if i.dataAddr == 0 {
+		return nil, nil
+	}
+
+	if err := i.setHeapState(ctx, i.evalHeapPtr); err != nil {
+		return nil, err
+	}
+
+	serialized, err := i.jsonDump(ctx, i.dataAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := i.module.readUntil(serialized, 0b0)
+	if err := i.setHeapState(ctx, i.evalHeapPtr); err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// apply checks the operation against the document, and returns the
+// document patched. The value is stored as JSON decodes it, for the
+// operations following to check against.
+func (op PatchOp) apply(doc interface{}) (interface{}, error) {
+	switch op.Op {
+	case PatchAdd, PatchRemove, PatchReplace:
+	default:
+		return nil, fmt.Errorf("unknown operation")
+	}
+
+	if len(op.Path) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	var value interface{}
+	if op.Op != PatchRemove {
+		raw, err := json.Marshal(op.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	return op.set(doc, op.Path, value)
+}
+
+// set returns a copy of the object with the value set at the path, or
+// removed, the parents missing created if adding.
+func (op PatchOp) set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	key := path[0]
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: not an object", key)
+	}
+
+	child, ok := obj[key]
+	if !ok {
+		if op.Op != PatchAdd {
+			return nil, fmt.Errorf("%s: not found", key)
+		}
+		child = map[string]interface{}{}
+	}
+
+	if len(path) > 1 {
+		var err error
+		if value, err = op.set(child, path[1:], value); err != nil {
+			return nil, err
+		}
+	}
+
+	m := make(map[string]interface{}, len(obj)+1)
+	for k, v := range obj {
+		m[k] = v
+	}
+
+	if op.Op == PatchRemove && len(path) == 1 {
+		delete(m, key)
+	} else {
+		m[key] = value
+	}
+	return m, nil
+}
@@ -4,15 +4,25 @@ import (
 	"bytes"
 	"context"
 	"sync"
+	"time"
 
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/metrics"
-	"github.com/tetratelabs/wazero"
+	"github.com/open-policy-agent/opa/topdown"
 )
 
 var errNotReady = errors.New(errors.NotReadyErr, "")
 
-const PageSize = 65535
+// ErrPreempted is returned by the evaluations stopped as another one got
+// cancelled, the engine interrupting them all: they are to be retried,
+// on another VM.
+var ErrPreempted = errors.New(errors.InternalErr, "preempted by the cancellation of another evaluation")
+
+// minEvictInterval is the minimum interval between the checks for the
+// VMs left idle.
+const minEvictInterval = time.Millisecond
+
+const PageSize = 65536
 
 func Pages(n uint32) uint32 {
 	pages := n / PageSize
@@ -23,22 +33,65 @@ func Pages(n uint32) uint32 {
 	return pages + 1
 }
 
+// wrapErr returns the SDK errors as is, and any other error as an SDK
+// error of the code.
+func wrapErr(code string, err error) error {
+	if errors.IsError(err) {
+		return err
+	}
+	return errors.New(code, err.Error())
+}
+
 // Pool maintains a pool of WebAssemly VM instances.
+//
+// The policy and data updates are generation based: a VM is built and
+// updated aside, to seed a new generation of VMs, while the evaluations
+// keep going on the VMs of the previous generation. Once it is
+// activated, the idle VMs of the previous generations are closed, the
+// busy ones as released, and more VMs of the new generation are built
+// in the background.
 type Pool struct {
 	available      chan struct{}
 	mutex          sync.Mutex
-	dataMtx        sync.Mutex
+	dataMtx        sync.Mutex // Serializes the policy and data updates.
 	initialized    bool
 	closed         bool
+	engine         Engine   // Shared by all VMs, owns the compiled code.
+	compiled       Compiled // Policy compiled once, instantiated by every VM.
 	policy         []byte
-	parsedData     []byte // Parsed parsedData memory segment, used to seed new VM's
-	parsedDataAddr int32  // Address for parsedData value root, used to seed new VM's
+	entrypoints    map[string]int32 // Entrypoint IDs of the policy, by name.
+	parsedData     []byte           // Parsed parsedData memory segment, used to seed new VM's
+	parsedDataAddr int32            // Address for parsedData value root, used to seed new VM's
 	memoryMinPages uint32
 	memoryMaxPages uint32
-	vms            []*VM // All current VM instances, acquired or not.
+	strict         bool                           // Strict builtin errors mode of the VMs.
+	builtins       map[string]topdown.BuiltinFunc // Custom builtins of the VMs, by name.
+	vms            []*VM                          // All current VM instances, acquired or not.
 	acquired       []bool
-	pendingReinit  *VM
-	blockedReinit  chan struct{}
+	released       []time.Time    // Time each VM got released last.
+	generation     uint64         // Generation of the policy and data seeding new VMs.
+	revision       uint64         // Data revision of the generation.
+	retired        []Compiled     // Compiled policies of the previous generations, still instantiated.
+	instantiating  int            // VMs being instantiated, out of the mutex.
+	builders       sync.WaitGroup // Background builds of VMs of a new generation.
+	minSize        uint32         // VMs built at initialization, and kept if idle.
+	idleTimeout    time.Duration  // Idle time after which VMs beyond the minimum are closed, 0 if never.
+	closing        chan struct{}  // Signals the request to stop the evictor.
+	evictorDone    chan struct{}  // Signals the successful stopping of the evictor.
+	recycleEvals   uint32         // Evaluations after which a VM is rebuilt, 0 if never.
+	recycleMemory  uint32         // Memory size, in bytes, beyond which a VM is rebuilt, 0 if never.
+	recycled       int            // VMs rebuilt so far.
+}
+
+// PoolStats are the numbers of VMs of a pool.
+type PoolStats struct {
+	Live     int // VMs instantiated, idle or in use.
+	Idle     int // VMs available for evaluations.
+	InUse    int // VMs evaluating.
+	Draining int // VMs evaluating, of a previous policy or data generation.
+
+	// Recycled is the number of VMs rebuilt so far, as worn out.
+	Recycled int
 }
 
 // NewPool constructs a new pool with the pool and VM configuration provided.
@@ -52,12 +105,82 @@ func NewPool(poolSize, memoryMinPages, memoryMaxPages uint32) *Pool {
 	return &Pool{
 		memoryMinPages: memoryMinPages,
 		memoryMaxPages: memoryMaxPages,
+		engine:         engines[DefaultEngine](),
 		available:      available,
 		vms:            make([]*VM, 0),
 		acquired:       make([]bool, 0),
+		minSize:        1,
 	}
 }
 
+// SetMinSize configures the number of VMs built at initialization, and
+// kept once idle. The default is a single one. Like the strict mode, it
+// has to be set before the policy.
+func (p *Pool) SetMinSize(size uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.minSize = size
+}
+
+// SetIdleTimeout configures the time after which the VMs left idle are
+// closed, down to the minimum size. They are never closed by default.
+// Like the strict mode, it has to be set before the policy.
+func (p *Pool) SetIdleTimeout(timeout time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.idleTimeout = timeout
+}
+
+// SetRecycling configures the VMs to be rebuilt from the current policy
+// and data once released after a number of evaluations, or with their
+// memory grown beyond a size in bytes, to release the memory large
+// inputs grew. The VMs are rebuilt in the background, holding their
+// slot meanwhile. Zero disables either. Like the strict mode, it has to
+// be set before the policy.
+func (p *Pool) SetRecycling(evals, memory uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.recycleEvals, p.recycleMemory = evals, memory
+}
+
+// SetStrictBuiltinErrors configures whether the errors of builtins fail
+// the evaluation instead of making the builtin call undefined. It
+// applies to the VMs constructed afterwards, hence has to be set before
+// the policy.
+func (p *Pool) SetStrictBuiltinErrors(strict bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.strict = strict
+}
+
+// SetEngine replaces the engine the VMs run on, see Engines for the
+// ones available. Like the builtins, it has to be set before the policy.
+func (p *Pool) SetEngine(name string) error {
+	engine, err := NewEngine(name)
+	if err != nil {
+		return errors.New(errors.InvalidConfigErr, err.Error())
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.initialized {
+		engine.Close(context.Background())
+		return errors.New(errors.InvalidConfigErr, "engine: policy already set")
+	}
+	p.engine.Close(context.Background())
+	p.engine = engine
+	return nil
+}
+
+// SetBuiltins configures the custom builtins, by name, the VMs dispatch
+// to in addition to the OPA builtins. Like the strict mode, it has to
+// be set before the policy.
+func (p *Pool) SetBuiltins(builtins map[string]topdown.BuiltinFunc) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.builtins = builtins
+}
+
 // ParsedData returns a reference to the pools parsed external data used to
 // initialize new VM's.
 func (p *Pool) ParsedData() (int32, []byte) {
@@ -73,11 +196,41 @@ func (p *Pool) Policy() []byte {
 	return p.policy
 }
 
+// Entrypoints returns a mapping of entrypoint name to ID of the policy
+// VM's in the pool are instantiated from.
+func (p *Pool) Entrypoints() map[string]int32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.entrypoints
+}
+
 // Size returns the current number of VM's in the pool
 func (p *Pool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return len(p.vms)
 }
 
+// Stats returns the current numbers of VMs in the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := PoolStats{Live: len(p.vms), Recycled: p.recycled}
+	for i, acquired := range p.acquired {
+		if !acquired {
+			continue
+		}
+
+		stats.InUse++
+		if p.vms[i].generation != p.generation {
+			stats.Draining++
+		}
+	}
+	stats.Idle = stats.Live - stats.InUse
+	return stats
+}
+
 // Acquire obtains a VM from the pool, waiting if all VMms are in use
 // and building one as necessary. Returns either ErrNotReady or
 // ErrInternal if an error.
@@ -87,7 +240,7 @@ func (p *Pool) Acquire(ctx context.Context, metrics metrics.Metrics) (*VM, error
 
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return nil, errors.New(errors.CancelledErr, ctx.Err().Error())
 	case <-p.available:
 	}
 
@@ -95,9 +248,11 @@ func (p *Pool) Acquire(ctx context.Context, metrics metrics.Metrics) (*VM, error
 	defer p.mutex.Unlock()
 
 	if !p.initialized || p.closed {
+		p.available <- struct{}{}
 		return nil, errNotReady
 	}
 
+	// The VMs idle are all of the current generation.
 	for i, vm := range p.vms {
 		if !p.acquired[i] {
 			p.acquired[i] = true
@@ -105,253 +260,683 @@ func (p *Pool) Acquire(ctx context.Context, metrics metrics.Metrics) (*VM, error
 		}
 	}
 
-	policy, parsedData, parsedDataAddr := p.policy, p.parsedData, p.parsedDataAddr
+	opts, generation := p.seed()
 	p.mutex.Unlock()
-	runt := (wazero.NewRuntime())
-	vm, err := newVM(vmOpts{
-		policy:         policy,
-		data:           nil,
-		parsedData:     parsedData,
-		parsedDataAddr: parsedDataAddr,
-		memoryMin:      p.memoryMinPages,
-		memoryMax:      p.memoryMaxPages,
-	}, &runt)
+	vm, err := newVM(opts, p.engine)
 	p.mutex.Lock()
 	if err != nil {
+		p.instantiated()
 		p.available <- struct{}{}
-		return nil, errors.New(errors.InternalErr, err.Error())
+		return nil, wrapErr(errors.InternalErr, err)
 	}
 
+	// Of a previous generation if updated meanwhile, the VM is closed
+	// once released.
+	vm.generation = generation
 	p.acquired = append(p.acquired, true)
+	p.released = append(p.released, time.Time{})
 	p.vms = append(p.vms, vm)
+	p.instantiated()
 	return vm, nil
 }
 
-// Release releases the VM back to the pool.
+// Release releases the VM back to the pool. The VM is closed instead if
+// its evaluation failed midway, or if it is of a previous generation. A
+// worn VM is rebuilt in the background, see recycle.
 func (p *Pool) Release(vm *VM, metrics metrics.Metrics) {
 	metrics.Timer("wasm_pool_release").Start()
 	defer metrics.Timer("wasm_pool_release").Stop()
 
 	p.mutex.Lock()
+	for i := range p.vms {
+		if p.vms[i] != vm {
+			continue
+		}
 
-	// If the policy data setting is waiting for this one, don't release it back to the general consumption.
-	// Note the reinit is responsible for pushing to available channel once done with the VM.
-	if vm == p.pendingReinit {
-		p.mutex.Unlock()
-		p.blockedReinit <- struct{}{}
-		return
+		if vm.Dirty() || vm.generation != p.generation {
+			// Either the instance state is undefined or the instance
+			// is outdated: the next Acquire instantiates a fresh one
+			// as necessary.
+			p.drop(i)
+			p.closeRetired()
+		} else if p.worn(vm) {
+			p.recycle(vm)
+			p.mutex.Unlock()
+			return
+		} else {
+			p.acquired[i] = false
+			p.released[i] = time.Now()
+		}
+		break
 	}
+	p.mutex.Unlock()
 
-	for i := range p.vms {
-		if p.vms[i] == vm {
+	p.available <- struct{}{}
+}
+
+// worn returns true if the VM is to be rebuilt, as per the recycling
+// configured. Called with the mutex held.
+func (p *Pool) worn(vm *VM) bool {
+	return (p.recycleEvals > 0 && vm.evals >= p.recycleEvals) ||
+		(p.recycleMemory > 0 && vm.memorySize() > p.recycleMemory)
+}
+
+// recycle rebuilds the VM released in the background, from the policy
+// and data the new VMs are seeded with, at the initial memory size. The
+// VM stays acquired meanwhile, holding its slot: once built, the new VM
+// takes its place, and the slot is handed back. If the build fails, or
+// the generation changed meanwhile, the VM is closed instead. Called
+// with the mutex held.
+func (p *Pool) recycle(vm *VM) {
+	opts, generation := p.seed()
+	p.builders.Add(1)
+
+	go func() {
+		defer p.builders.Done()
+
+		n, err := newVM(opts, p.engine)
+
+		p.mutex.Lock()
+		for i := range p.vms {
+			if p.vms[i] != vm {
+				continue
+			}
+
+			if err != nil || p.generation != generation {
+				p.drop(i)
+				break
+			}
+
+			vm.Close()
+			n.generation = generation
+			p.vms[i] = n
 			p.acquired[i] = false
-			p.mutex.Unlock()
-			p.available <- struct{}{}
-			return
+			p.released[i] = time.Now()
+			p.recycled++
+			n = nil
+			break
 		}
+		if err == nil && n != nil {
+			n.Close()
+		}
+		p.instantiated()
+		p.mutex.Unlock()
+
+		p.available <- struct{}{}
+	}()
+}
+
+// Update is a policy or data update of a pool, prepared aside to be
+// committed, or aborted. The updates of a pool are serialized: once
+// prepared, an update delays the next ones until committed or aborted.
+type Update struct {
+	pool     *Pool
+	vms      []*VM    // The seed of the new generation first, then its replicas.
+	compiled Compiled // Policy compiled for the update, nil if unchanged.
+	done     bool
+}
+
+// Entrypoints returns a mapping of entrypoint name to ID of the policy
+// of the update.
+func (u *Update) Entrypoints() map[string]int32 {
+	return u.vms[0].Entrypoints()
+}
+
+// Commit activates the update, as the data revision given: the VMs
+// acquired afterwards are all of the update, see Pool. It returns
+// ErrNotReady if the pool got closed meanwhile, the update then
+// aborted.
+func (u *Update) Commit(revision uint64) error {
+	if u.done {
+		return nil
 	}
 
-	// VM instance not found anymore, hence pool reconfigured and can release the VM.
+	u.done = true
+	defer u.pool.dataMtx.Unlock()
 
-	p.mutex.Unlock()
-	p.available <- struct{}{}
+	if err := u.pool.activate(u.vms, revision); err != nil {
+		if u.compiled != nil {
+			u.compiled.Close(context.Background())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Abort discards the update.
+func (u *Update) Abort() {
+	if u.done {
+		return
+	}
+
+	u.done = true
+	defer u.pool.dataMtx.Unlock()
+
+	for _, vm := range u.vms {
+		vm.Close()
+	}
+
+	if u.compiled != nil {
+		u.compiled.Close(context.Background())
+	}
 }
 
 // SetPolicyData re-initializes the vms within the pool with the new policy
-// and data. The re-initialization takes place atomically: all new vms
-// are constructed in advance before touching the pool.  Returns
-// either ErrNotReady, ErrInvalidPolicy or ErrInternal if an error
-// occurs.
+// and data, as the next data revision. See PreparePolicyData for the
+// errors.
 func (p *Pool) SetPolicyData(ctx context.Context, policy []byte, data []byte) error {
-	p.dataMtx.Lock()
-	defer p.dataMtx.Unlock()
-	p.mutex.Lock()
+	u, err := p.PreparePolicyData(ctx, policy, data)
+	if err != nil {
+		return err
+	}
 
-	if !p.initialized {
-		runt := wazero.NewRuntime()
-		vm, err := newVM(vmOpts{
-			policy:         policy,
-			data:           data,
-			parsedData:     nil,
-			parsedDataAddr: 0,
-			memoryMin:      p.memoryMinPages,
-			memoryMax:      p.memoryMaxPages,
-		}, &runt)
-		if err == nil {
-			parsedDataAddr, parsedData := vm.cloneDataSegment()
-			p.memoryMinPages = uint32(vm.memoryMin)
-			p.vms = append(p.vms, vm)
-			p.acquired = append(p.acquired, false)
-			p.initialized = true
-			p.policy, p.parsedData, p.parsedDataAddr = policy, parsedData, parsedDataAddr
-		} else {
-			err = errors.New(errors.InvalidPolicyOrDataErr, err.Error())
-		}
+	return u.Commit(p.DataRevision() + 1)
+}
 
-		p.mutex.Unlock()
+// SetDataPath will update the current data on the VMs by setting the value at the
+// specified path, as the next data revision. If an error occurs the
+// instance is still in a valid state, however the data will not have
+// been modified.
+func (p *Pool) SetDataPath(ctx context.Context, path []string, value interface{}) error {
+	u, err := p.PrepareDataPath(ctx, path, value)
+	if err != nil {
 		return err
 	}
 
+	return u.Commit(p.DataRevision() + 1)
+}
+
+// RemoveDataPath will update the current data on the VMs by removing the value at the
+// specified path, as the next data revision. If an error occurs the
+// instance is still in a valid state, however the data will not have
+// been modified.
+func (p *Pool) RemoveDataPath(ctx context.Context, path []string) error {
+	u, err := p.PrepareRemoveDataPath(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	return u.Commit(p.DataRevision() + 1)
+}
+
+// DataRevision returns the data revision the VMs acquired are of.
+func (p *Pool) DataRevision() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.revision
+}
+
+// PreparePolicyData prepares an update of the policy and data,
+// building a VM with them aside, the evaluations going on meanwhile.
+// The policy is compiled once up front, unless unchanged. If not
+// initialized yet, the pool is warmed up by the update. Returns either
+// ErrNotReady, ErrInvalidPolicy or ErrInternal if an error occurs.
+func (p *Pool) PreparePolicyData(ctx context.Context, policy []byte, data []byte) (*Update, error) {
+	p.dataMtx.Lock()
+	u, err := p.preparePolicyData(ctx, policy, data)
+	if err != nil {
+		p.dataMtx.Unlock()
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// preparePolicyData prepares an update of the policy and data. Called
+// with the data mutex held.
+func (p *Pool) preparePolicyData(ctx context.Context, policy []byte, data []byte) (*Update, error) {
+	p.mutex.Lock()
 	if p.closed {
 		p.mutex.Unlock()
-		return errNotReady
+		return nil, errNotReady
 	}
 
-	currentPolicy, currentData := p.policy, p.parsedData
+	initialized := p.initialized
+	opts := vmOpts{
+		policy:    policy,
+		data:      data,
+		memoryMin: p.memoryMinPages,
+		memoryMax: p.memoryMaxPages,
+		strict:    p.strict,
+		builtins:  p.builtins,
+	}
 	p.mutex.Unlock()
 
-	if bytes.Equal(policy, currentPolicy) && bytes.Equal(data, currentData) {
-		return nil
+	compiled, err := p.compile(ctx, policy)
+	if err != nil {
+		return nil, err
 	}
 
-	err := p.setPolicyData(ctx, policy, data)
+	u := &Update{pool: p}
+	if !initialized || compiled != p.Compiled() {
+		u.compiled = compiled
+	}
+
+	// The policy errors of a pool not initialized yet are all
+	// reported as such.
+	code := errors.InternalErr
+	if !initialized {
+		code = errors.InvalidPolicyOrDataErr
+	}
+
+	opts.compiled = compiled
+	vm, err := newVM(opts, p.engine)
 	if err != nil {
-		return errors.New(errors.InternalErr, err.Error())
+		if u.compiled != nil {
+			compiled.Close(ctx)
+		}
+		return nil, wrapErr(code, err)
 	}
 
-	return nil
+	if u.vms, err = p.replicate(vm, opts); err != nil {
+		if u.compiled != nil {
+			compiled.Close(ctx)
+		}
+		return nil, wrapErr(errors.InternalErr, err)
+	}
+
+	return u, nil
 }
 
-// SetDataPath will update the current data on the VMs by setting the value at the
-// specified path. If an error occurs the instance is still in a valid state, however
-// the data will not have been modified.
-func (p *Pool) SetDataPath(ctx context.Context, path []string, value interface{}) error {
-	p.dataMtx.Lock()
-	defer p.dataMtx.Unlock()
-	return p.updateVMs(func(vm *VM, opts vmOpts) error {
+// PrepareDataPath prepares an update of the data, setting the value at
+// the specified path of the data of a VM built aside. See SetDataPath.
+func (p *Pool) PrepareDataPath(ctx context.Context, path []string, value interface{}) (*Update, error) {
+	return p.prepareData(func(vm *VM) error {
 		return vm.SetDataPath(ctx, path, value)
 	})
 }
 
-// RemoveDataPath will update the current data on the VMs by removing the value at the
-// specified path. If an error occurs the instance is still in a valid state, however
-// the data will not have been modified.
-func (p *Pool) RemoveDataPath(ctx context.Context, path []string) error {
-	p.dataMtx.Lock()
-	defer p.dataMtx.Unlock()
-	return p.updateVMs(func(vm *VM, _ vmOpts) error {
+// PrepareRemoveDataPath prepares an update of the data, removing the
+// value at the specified path of the data of a VM built aside. See
+// RemoveDataPath.
+func (p *Pool) PrepareRemoveDataPath(ctx context.Context, path []string) (*Update, error) {
+	return p.prepareData(func(vm *VM) error {
 		return vm.RemoveDataPath(ctx, path)
 	})
 }
 
-// setPolicyData reinitializes the VMs one at a time.
-func (p *Pool) setPolicyData(ctx context.Context, policy []byte, data []byte) error {
-	return p.updateVMs(func(vm *VM, opts vmOpts) error {
-		opts.policy = policy
-		opts.data = data
-		return vm.SetPolicyData(ctx, opts)
+// PreparePatch prepares an update of the data, applying the operations
+// in order to the data of a VM built aside, all or none. See VM.Patch.
+func (p *Pool) PreparePatch(ctx context.Context, ops []PatchOp) (*Update, error) {
+	return p.prepareData(func(vm *VM) error {
+		return vm.Patch(ctx, ops)
 	})
 }
 
-// updateVMs Iterates over each VM, waiting for each to safely acquire them,
-// and applies the update function. If the first update succeeds any subsequent
-// failures will remove the VM and continue through the pool. Otherwise an error
-// will be returned.
-func (p *Pool) updateVMs(update func(vm *VM, opts vmOpts) error) error {
-	var policy []byte
-	var parsedData []byte
-	var parsedDataAddr int32
-	seedMemorySize := p.memoryMinPages
-	activated := false
-	i := 0
-	for {
-		vm := p.Wait(i)
-		if vm == nil {
-			// All have been updated or removed.
-			return nil
+// prepareData builds a VM of the current generation and updates its
+// data, and then its replicas, for an update.
+func (p *Pool) prepareData(update func(vm *VM) error) (*Update, error) {
+	p.dataMtx.Lock()
+
+	p.mutex.Lock()
+	if !p.initialized || p.closed {
+		p.mutex.Unlock()
+		p.dataMtx.Unlock()
+		return nil, errNotReady
+	}
+
+	opts, _ := p.seed()
+	p.mutex.Unlock()
+
+	vm, err := newVM(opts, p.engine)
+
+	// The policy compiled cannot be retired meanwhile, as the updates
+	// are serialized.
+	p.mutex.Lock()
+	p.instantiated()
+	p.mutex.Unlock()
+
+	if err != nil {
+		p.dataMtx.Unlock()
+		return nil, wrapErr(errors.InternalErr, err)
+	}
+
+	if err := update(vm); err != nil {
+		// No guarantee about the VM state after an error; hence, drop.
+		vm.Close()
+		p.dataMtx.Unlock()
+		return nil, err
+	}
+
+	vms, err := p.replicate(vm, opts)
+	if err != nil {
+		p.dataMtx.Unlock()
+		return nil, wrapErr(errors.InternalErr, err)
+	}
+
+	return &Update{pool: p, vms: vms}, nil
+}
+
+// compile returns the compiled module for the policy, reusing the
+// currently active one if the policy has not changed.
+func (p *Pool) compile(ctx context.Context, policy []byte) (Compiled, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.compiled != nil && bytes.Equal(policy, p.policy) {
+		return p.compiled, nil
+	}
+
+	compiled, err := p.engine.Compile(ctx, policy)
+	if err != nil {
+		return nil, errors.New(errors.InvalidPolicyOrDataErr, err.Error())
+	}
+	return compiled, nil
+}
+
+// Compiled returns the compiled policy module VMs are instantiated from.
+func (p *Pool) Compiled() Compiled {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.compiled
+}
+
+// activate makes the VMs of an update, built with a new policy or data,
+// a new generation of VMs, the first one seeding the VMs built
+// afterwards. The idle VMs of the previous generations are replaced at
+// once by the ones of the update, which were built aside as many as
+// there were live. The ones still evaluating drain in place, counting
+// against the pool size until released: as many of the update are
+// closed. If more got live meanwhile, the missing ones are built in the
+// background. Called with the data mutex held.
+func (p *Pool) activate(vms []*VM, revision uint64) error {
+	vm := vms[0]
+	parsedDataAddr, parsedData := vm.cloneDataSegment()
+	memoryMinPages := Pages(vm.memorySize())
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		for _, vm := range vms {
+			vm.Close()
 		}
-		err := update(vm, vmOpts{
-			policy:         policy,
-			parsedData:     parsedData,
-			parsedDataAddr: parsedDataAddr,
-			memoryMin:      seedMemorySize,
-			memoryMax:      p.memoryMaxPages, // The max pages cannot be changed while updating.
-		})
-		if err != nil {
-			// No guarantee about the VM state after an error; hence, remove.
-			p.remove(i)
-			p.Release(vm, metrics.New())
-			// After the first successful activation, proceed through all the VMs, ignoring the remaining errors.
-			if !activated {
-				return err
+		return errNotReady
+	}
+
+	draining := 0
+	for i := range p.vms {
+		if p.acquired[i] {
+			draining++
+		}
+	}
+
+	// An empty pool keeps the seed warm.
+	room := 1
+	if live := int(p.target()); live > 0 {
+		room = live - draining
+	}
+	for len(vms) > room {
+		vms[len(vms)-1].Close()
+		vms = vms[:len(vms)-1]
+	}
+
+	p.generation++
+	p.revision = revision
+	if p.compiled != nil && p.compiled != vm.compiled {
+		p.retired = append(p.retired, p.compiled)
+	}
+	p.policy, p.compiled, p.entrypoints = vm.policy, vm.compiled, vm.Entrypoints()
+	p.parsedData, p.parsedDataAddr, p.memoryMinPages = parsedData, parsedDataAddr, memoryMinPages
+
+	// Walk backwards, as the removal moves the last VM to the index.
+	for i := len(p.vms) - 1; i >= 0; i-- {
+		if !p.acquired[i] {
+			p.drop(i)
+		}
+	}
+
+	now := time.Now()
+	for _, vm := range vms {
+		vm.generation, vm.revision = p.generation, revision
+		p.vms = append(p.vms, vm)
+		p.acquired = append(p.acquired, false)
+		p.released = append(p.released, now)
+	}
+	p.closeRetired()
+
+	if !p.initialized {
+		// Warmed up already.
+		p.initialized = true
+		if p.idleTimeout > 0 {
+			p.closing = make(chan struct{})
+			p.evictorDone = make(chan struct{})
+			go p.evictor(p.idleTimeout, p.closing, p.evictorDone)
+		}
+		return nil
+	}
+
+	if n := room - len(vms); n > 0 {
+		p.build(n)
+	}
+	return nil
+}
+
+// build builds VMs of the current generation in the background, as
+// long as it remains current and the pool is not full. Called with the
+// mutex held.
+func (p *Pool) build(n int) {
+	opts, generation := p.seed()
+	p.builders.Add(1)
+
+	go func() {
+		defer p.builders.Done()
+		defer func() {
+			p.mutex.Lock()
+			p.instantiated()
+			p.mutex.Unlock()
+		}()
+
+		for i := 0; i < n; i++ {
+			vm, err := newVM(opts, p.engine)
+			if err != nil {
+				// Left for Acquire to build.
+				return
 			}
-			// Note: Do not increment i when it has been removed! That index is
-			// replaced by the last VM in the list so we must re-run with the
-			// same index.
-		} else {
-			if !activated {
-				// Activate the policy and data, now that a single VM has been reset without errors.
-				activated = true
-				policy = vm.policy
-				parsedDataAddr, parsedData = vm.cloneDataSegment()
-				seedMemorySize = Pages(uint32(vm.module.env.Memory().Size(context.Background())))
-				p.activate(policy, parsedData, parsedDataAddr, seedMemorySize)
+
+			p.mutex.Lock()
+			if p.closed || p.generation != generation || len(p.vms) >= cap(p.available) {
+				p.mutex.Unlock()
+				vm.Close()
+				return
 			}
 
-			p.Release(vm, metrics.New())
-			// Only increment on success
-			i++
+			vm.generation = generation
+			p.vms = append(p.vms, vm)
+			p.acquired = append(p.acquired, false)
+			p.released = append(p.released, time.Now())
+			p.mutex.Unlock()
 		}
-	}
+	}()
 }
 
-// Close waits for all the evaluations to finish and then releases the VMs.
-func (p *Pool) Close() {
-	for range p.vms {
-		<-p.available
+// seed returns the options to instantiate a VM of the current
+// generation with, and the generation. The instantiation is in
+// progress until instantiated is called. Called with the mutex held.
+func (p *Pool) seed() (vmOpts, uint64) {
+	p.instantiating++
+	return vmOpts{
+		policy:         p.policy,
+		compiled:       p.compiled,
+		parsedData:     p.parsedData,
+		parsedDataAddr: p.parsedDataAddr,
+		memoryMin:      p.memoryMinPages,
+		memoryMax:      p.memoryMaxPages,
+		strict:         p.strict,
+		builtins:       p.builtins,
+		revision:       p.revision,
+	}, p.generation
+}
+
+// instantiated ends an instantiation started with seed. Called with the
+// mutex held.
+func (p *Pool) instantiated() {
+	p.instantiating--
+	p.closeRetired()
+}
+
+// closeRetired closes the compiled policies of the previous generations
+// no VM is instantiated from anymore. Called with the mutex held.
+func (p *Pool) closeRetired() {
+	if p.instantiating > 0 || p.closed {
+		// An instantiation may refer to any; the engine closes all.
+		return
 	}
 
+	retired := p.retired[:0]
+	for _, compiled := range p.retired {
+		used := false
+		for _, vm := range p.vms {
+			if vm.compiled == compiled {
+				used = true
+				break
+			}
+		}
+
+		if used {
+			retired = append(retired, compiled)
+		} else {
+			compiled.Close(context.Background())
+		}
+	}
+	p.retired = retired
+}
+
+// replicate returns the VMs of an update, the seed given and its
+// replicas instantiated from its data, as many as the pool is to keep
+// live: the evaluations go on with the VMs of the current generation
+// meanwhile, not to wait for the ones of the update once committed. If
+// any fails, all are closed.
+func (p *Pool) replicate(seed *VM, opts vmOpts) ([]*VM, error) {
 	p.mutex.Lock()
-	defer p.mutex.Unlock()
+	n := p.target()
+	p.mutex.Unlock()
 
-	p.closed = true
-	p.vms = nil
+	opts.data = nil
+	opts.parsedDataAddr, opts.parsedData = seed.cloneDataSegment()
+	opts.memoryMin = Pages(seed.memorySize())
+
+	vms := []*VM{seed}
+	for uint32(len(vms)) < n {
+		vm, err := newVM(opts, p.engine)
+		if err != nil {
+			for _, vm := range vms {
+				vm.Close()
+			}
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// target returns the number of VMs to keep live: as many as live, the
+// minimum size at least and the pool size at most. Called with the mutex
+// held.
+func (p *Pool) target() uint32 {
+	live := uint32(len(p.vms))
+	if live < p.minSize {
+		live = p.minSize
+	}
+	if max := uint32(cap(p.available)); live > max {
+		live = max
+	}
+	return live
 }
 
-// Wait steals the i'th VM instance. The VM has to be released afterwards.
-func (p *Pool) Wait(i int) *VM {
+// evictor periodically closes the VMs left idle for longer than the
+// timeout, until the pool is closed. It checks twice per timeout, but
+// not more often than minEvictInterval.
+func (p *Pool) evictor(timeout time.Duration, closing <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := timeout / 2
+	if interval < minEvictInterval {
+		interval = minEvictInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			p.evict(now.Add(-timeout))
+		case <-closing:
+			return
+		}
+	}
+}
+
+// evict closes the VMs idle since before the deadline, down to the
+// minimum size.
+func (p *Pool) evict(deadline time.Time) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	if i == len(p.vms) {
-		return nil
-	}
-	vm := p.vms[i]
-	isActive := p.acquired[i]
-	p.acquired[i] = true
-	if isActive {
-		p.blockedReinit = make(chan struct{}, 1)
-		p.pendingReinit = vm
+
+	// Walk backwards, as the removal moves the last VM to the index.
+	for i := len(p.vms) - 1; i >= 0 && uint32(len(p.vms)) > p.minSize; i-- {
+		if !p.acquired[i] && p.released[i].Before(deadline) {
+			p.drop(i)
+		}
 	}
+}
 
+// Close waits for all the evaluations to finish and then releases the VMs.
+// Acquire returns ErrNotReady afterwards.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	closing, evictorDone := p.closing, p.evictorDone
+	p.closing, p.evictorDone = nil, nil
 	p.mutex.Unlock()
-	if isActive {
-		<-p.blockedReinit
-	} else {
+
+	if closing != nil {
+		close(closing)
+		<-evictorDone
+	}
+
+	n := cap(p.available)
+	for i := 0; i < n; i++ {
 		<-p.available
 	}
+
 	p.mutex.Lock()
-	p.pendingReinit = nil
-	return vm
-}
+	p.closed = true
+	p.mutex.Unlock()
+
+	// The VMs built in the background meanwhile are closed as built.
+	p.builders.Wait()
 
-// remove removes the i'th vm.
-func (p *Pool) remove(i int) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	p.vms[i].module.module.Close(p.vms[i].ctx)
-	p.vms[i].module.env.Close(p.vms[i].ctx)
+
+	for _, vm := range p.vms {
+		vm.Close()
+	}
+	p.vms = nil
+	p.acquired = nil
+	p.released = nil
+	p.engine.Close(context.Background())
+
+	// Wake up the ones waiting in Acquire, to fail.
+	for i := 0; i < n; i++ {
+		p.available <- struct{}{}
+	}
+}
+
+// drop closes and removes the i'th vm, moving the last one to its
+// index. Called with the mutex held.
+func (p *Pool) drop(i int) {
+	p.vms[i].Close()
 	n := len(p.vms)
 	if n > 1 {
 		p.vms[i] = p.vms[n-1]
 		p.acquired[i] = p.acquired[n-1]
+		p.released[i] = p.released[n-1]
 	}
 
 	p.vms = p.vms[0 : n-1]
 	p.acquired = p.acquired[0 : n-1]
-}
-
-func (p *Pool) activate(policy []byte, data []byte, dataAddr int32, minMemoryPages uint32) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.policy, p.parsedData, p.parsedDataAddr, p.memoryMinPages = policy, data, dataAddr, minMemoryPages
+	p.released = p.released[0 : n-1]
 }
@@ -9,12 +9,14 @@ package wasm_test
 
 import (
 	"context"
+	goerrors "errors"
 	"math/rand"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
@@ -23,7 +25,7 @@ import (
 	"github.com/open-policy-agent/opa/util"
 )
 
-const PageSize = 65535
+const PageSize = 65536
 
 func TestOpaEvalGrowMemoryForLargeInput(t *testing.T) {
 	ctx := context.Background()
@@ -36,7 +38,7 @@ func TestOpaEvalGrowMemoryForLargeInput(t *testing.T) {
 
 	poolSize := 1
 	testPool := initPoolWithData(t, uint32(poolSize), module, "test/p", data)
-	expected := `{{"result":true}}`
+	expected := `[{"result":true}]`
 	ensurePoolResults(t, ctx, testPool, poolSize, &input, expected)
 }
 
@@ -97,7 +99,7 @@ func TestPoolCopyParsedDataUpdateFull(t *testing.T) {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
-	expected = `{{"result":[1,2,3]}}`
+	expected = `[{"result":[1,2,3]}]`
 	ensurePoolResults(t, ctx, testPool, poolSize, nil, expected)
 }
 
@@ -162,6 +164,404 @@ func TestPoolCopyParsedDataUpdatePartial(t *testing.T) {
 	}
 }
 
+func TestPoolRecycleFailedVM(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = 1 { input.a }
+	p = 2 { input.b }
+	`
+	testPool := initPoolWithData(t, 1, module, "test/p", []byte(`{}`))
+
+	vm, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var input interface{} = map[string]interface{}{"a": true, "b": true}
+	cfg, _ := cache.ParseCachingConfig(nil)
+	_, err = vm.Eval(ctx, 0, &input, metrics.New(), rand.New(rand.NewSource(0)), time.Now(), cache.NewInterQueryCache(cfg), nil, nil)
+	if !goerrors.Is(err, &errors.Error{Code: errors.InternalErr}) {
+		t.Fatalf("Expected an internal error, got: %v", err)
+	}
+
+	testPool.Release(vm, metrics.New())
+	if testPool.Size() != 0 {
+		t.Fatalf("Expected the failed vm to be removed from the pool, size: %d", testPool.Size())
+	}
+
+	input = map[string]interface{}{"a": true}
+	ensurePoolResults(t, ctx, testPool, 1, &input, `[{"result":1}]`)
+}
+
+func TestPoolIdleEviction(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = true
+	`, "test/p")
+
+	testPool := wasm.NewPool(4, 16, 100)
+	testPool.SetMinSize(2)
+	testPool.SetIdleTimeout(20 * time.Millisecond)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 2, Idle: 2}) {
+		t.Fatalf("Expected the minimum size warmed up, got: %+v", stats)
+	}
+
+	// Grow the pool to its maximum size.
+	var vms []*wasm.VM
+	for i := 0; i < 4; i++ {
+		vm, err := testPool.Acquire(ctx, metrics.New())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		vms = append(vms, vm)
+	}
+
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 4, InUse: 4}) {
+		t.Fatalf("Expected the maximum size in use, got: %+v", stats)
+	}
+
+	for _, vm := range vms {
+		testPool.Release(vm, metrics.New())
+	}
+
+	// Once idle, the pool shrinks back to its minimum size.
+	deadline := time.Now().Add(5 * time.Second)
+	for testPool.Size() > 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the idle vms to be evicted, got: %+v", testPool.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 2, Idle: 2}) {
+		t.Fatalf("Expected the minimum size kept, got: %+v", stats)
+	}
+
+	ensurePoolResults(t, ctx, testPool, 4, nil, `[{"result":true}]`)
+}
+
+func TestPoolIdleEvictionShortTimeout(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = true
+	`, "test/p")
+
+	// A timeout too short to tick at half of it does not panic.
+	testPool := wasm.NewPool(2, 16, 100)
+	testPool.SetIdleTimeout(time.Nanosecond)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":true}]`)
+}
+
+func TestPoolRecycleEvals(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = data.a
+	`, "test/p")
+
+	testPool := wasm.NewPool(1, 16, 100)
+	testPool.SetRecycling(2, 0)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{"a": 1}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	if err := testPool.SetDataPath(ctx, []string{"a"}, 2); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The VM is rebuilt every second evaluation, with the data patched.
+	for i := 0; i < 5; i++ {
+		ensurePoolResults(t, ctx, testPool, 1, nil, `[{"result":2}]`)
+	}
+
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 1, Idle: 1, Recycled: 2}) {
+		t.Fatalf("Expected the vm to be recycled twice, got: %+v", stats)
+	}
+}
+
+func TestPoolRecycleMemory(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = true
+	`, "test/p")
+
+	testPool := wasm.NewPool(1, 16, 100)
+	testPool.SetRecycling(0, 24*PageSize)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	ensurePoolResults(t, ctx, testPool, 1, nil, `[{"result":true}]`)
+	if stats := testPool.Stats(); stats.Recycled != 0 {
+		t.Fatalf("Expected no vm recycled, got: %+v", stats)
+	}
+
+	// A large input grows the memory beyond the threshold.
+	input := interface{}([]byte(strings.Repeat("a", 32*PageSize)))
+	ensurePoolResults(t, ctx, testPool, 1, &input, `[{"result":true}]`)
+
+	// The next evaluation waits for the vm rebuilt in the background.
+	ensurePoolResults(t, ctx, testPool, 1, nil, `[{"result":true}]`)
+	if stats := testPool.Stats(); stats.Recycled != 1 {
+		t.Fatalf("Expected the vm to be recycled, got: %+v", stats)
+	}
+
+	ensurePoolResults(t, ctx, testPool, 1, nil, `[{"result":true}]`)
+	if stats := testPool.Stats(); stats.Recycled != 1 {
+		t.Fatalf("Expected the vm rebuilt at its initial size, got: %+v", stats)
+	}
+}
+
+func TestPoolRecycleReplacesVM(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = true
+	`, "test/p")
+
+	testPool := wasm.NewPool(1, 16, 100)
+	testPool.SetRecycling(1, 0)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	worn, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	cfg, _ := cache.ParseCachingConfig(nil)
+	if _, err := worn.Eval(ctx, 0, nil, metrics.New(), rand.New(rand.NewSource(0)), time.Now(), cache.NewInterQueryCache(cfg), nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The release returns at once; the slot is handed back once rebuilt,
+	// to a new vm.
+	testPool.Release(worn, metrics.New())
+
+	vm, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Release(vm, metrics.New())
+
+	if vm == worn {
+		t.Fatal("Expected the worn vm to be replaced")
+	}
+
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 1, InUse: 1, Recycled: 1}) {
+		t.Fatalf("Expected the vm recycled once, got: %+v", stats)
+	}
+}
+
+func TestPoolUpdateNonBlocking(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = data.a
+	`
+	testPool := initPoolWithData(t, 2, module, "test/p", []byte(`{"a": 1}`))
+
+	busy, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The updates complete while a VM is busy.
+	done := make(chan error, 1)
+	go func() {
+		if err := testPool.SetDataPath(ctx, []string{"a"}, 2); err != nil {
+			done <- err
+			return
+		}
+		done <- testPool.SetPolicyData(ctx, testPool.Policy(), []byte(`{"a": 3}`))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the updates not to wait for the busy vm")
+	}
+
+	if stats := testPool.Stats(); stats.Draining != 1 {
+		t.Fatalf("Expected the busy vm draining, got: %+v", stats)
+	}
+
+	// The busy VM still evaluates with the data it was acquired with.
+	cfg, _ := cache.ParseCachingConfig(nil)
+	result, err := busy.Eval(ctx, 0, nil, metrics.New(), rand.New(rand.NewSource(0)), time.Now(), cache.NewInterQueryCache(cfg), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if expected := `[{"result":1}]`; string(result) != expected {
+		t.Fatalf("Expected %s, got: %s", expected, result)
+	}
+
+	ensurePoolResults(t, ctx, testPool, 1, nil, `[{"result":3}]`)
+
+	// Once released, the busy VM is closed.
+	testPool.Release(busy, metrics.New())
+	if stats := testPool.Stats(); stats.Draining != 0 || stats.InUse != 0 {
+		t.Fatalf("Expected the busy vm closed, got: %+v", stats)
+	}
+
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":3}]`)
+}
+
+func TestPoolUpdateDrainingBounded(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = data.a
+	`
+	testPool := initPoolWithData(t, 2, module, "test/p", []byte(`{"a": 1}`))
+
+	var busy []*wasm.VM
+	for i := 0; i < 2; i++ {
+		vm, err := testPool.Acquire(ctx, metrics.New())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		busy = append(busy, vm)
+	}
+
+	if err := testPool.SetDataPath(ctx, []string{"a"}, 2); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The busy VMs fill the pool, none of the update is kept.
+	if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 2, InUse: 2, Draining: 2}) {
+		t.Fatalf("Expected the draining vms counted against the pool size, got: %+v", stats)
+	}
+
+	for _, vm := range busy {
+		testPool.Release(vm, metrics.New())
+	}
+
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":2}]`)
+}
+
+func TestPoolCloseClosesVMs(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = true
+	`
+	testPool := initPoolWithData(t, 1, module, "test/p", []byte(`{}`))
+
+	vm, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	testPool.Release(vm, metrics.New())
+	testPool.Close()
+
+	cfg, _ := cache.ParseCachingConfig(nil)
+	if _, err := vm.Eval(ctx, 0, nil, metrics.New(), rand.New(rand.NewSource(0)), time.Now(), cache.NewInterQueryCache(cfg), nil, nil); err == nil {
+		t.Fatal("Expected the vm closed with the pool")
+	}
+}
+
+func TestPoolUpdateReplacesIdle(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = data.a
+	`
+	testPool := initPoolWithData(t, 3, module, "test/p", []byte(`{"a": 1}`))
+	ensurePoolResults(t, ctx, testPool, 3, nil, `[{"result":1}]`)
+
+	// The idle VMs are replaced at once, none left to build on Acquire.
+	for i, update := range []func() error{
+		func() error { return testPool.SetDataPath(ctx, []string{"a"}, 2) },
+		func() error { return testPool.SetPolicyData(ctx, testPool.Policy(), []byte(`{"a": 3}`)) },
+	} {
+		if err := update(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if stats := testPool.Stats(); stats != (wasm.PoolStats{Live: 3, Idle: 3}) {
+			t.Fatalf("Expected the idle vms replaced after update %d, got: %+v", i, stats)
+		}
+	}
+
+	ensurePoolResults(t, ctx, testPool, 3, nil, `[{"result":3}]`)
+}
+
+func TestPoolUpdateMemory(t *testing.T) {
+	ctx := context.Background()
+	policy := compilePolicy(t, `package test
+	p = data.a
+	`, "test/p")
+
+	// The memory of the VMs of every update starts at the size of the
+	// previous ones, not growing with the number of updates.
+	testPool := wasm.NewPool(2, 2, 100)
+	if err := testPool.SetPolicyData(ctx, policy, []byte(`{"a": 0}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer testPool.Close()
+
+	for i := 1; i <= 300; i++ {
+		if err := testPool.SetDataPath(ctx, []string{"a"}, i); err != nil {
+			t.Fatalf("Unexpected error on update %d: %s", i, err)
+		}
+	}
+
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":300}]`)
+}
+
+func TestPoolUpdateAbort(t *testing.T) {
+	ctx := context.Background()
+	module := `package test
+	p = data.a
+	`
+	testPool := initPoolWithData(t, 2, module, "test/p", []byte(`{"a": 1}`))
+
+	u, err := testPool.PrepareDataPath(ctx, []string{"a"}, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Not observed until committed.
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":1}]`)
+	u.Abort()
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":1}]`)
+
+	revision := testPool.DataRevision()
+	if u, err = testPool.PrepareDataPath(ctx, []string{"a"}, 3); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := u.Commit(revision + 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	ensurePoolResults(t, ctx, testPool, 2, nil, `[{"result":3}]`)
+	if r := testPool.DataRevision(); r != revision+1 {
+		t.Fatalf("Expected revision %d, got: %d", revision+1, r)
+	}
+}
+
 func ensurePoolResults(t *testing.T, ctx context.Context, testPool *wasm.Pool, poolSize int, input *interface{}, expected string) {
 	t.Helper()
 	var toRelease []*wasm.VM
@@ -192,27 +592,8 @@ func initPoolWithData(t *testing.T, size uint32, module string, entrypoint strin
 
 	ctx := context.Background()
 
-	compiler := compile.New().
-		WithTarget(compile.TargetWasm).
-		WithEntrypoints(entrypoint).
-		WithBundle(&bundle.Bundle{
-			Modules: []bundle.ModuleFile{
-				{
-					Path:   "policy.rego",
-					URL:    "policy.rego",
-					Raw:    []byte(module),
-					Parsed: ast.MustParseModule(module),
-				},
-			},
-		})
-
-	err := compiler.Build(ctx)
-	if err != nil {
-		t.Fatalf("Unexpected error: %s", err)
-	}
-
 	testPool := wasm.NewPool(size, 16, 100)
-	err = testPool.SetPolicyData(ctx, compiler.Bundle().WasmModules[0].Raw, data)
+	err := testPool.SetPolicyData(ctx, compilePolicy(t, module, entrypoint), data)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -230,11 +611,37 @@ func initPoolWithData(t *testing.T, size uint32, module string, entrypoint strin
 		t.Fatalf("Expected parsedData to be non-nil")
 	}
 
-	vm := testPool.Wait(0)
-	if vm == nil {
-		t.Fatalf("Expected non-nil initial vm")
+	vm, err := testPool.Acquire(ctx, metrics.New())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
 	}
 
 	testPool.Release(vm, metrics.New())
 	return testPool
 }
+
+// compilePolicy compiles the module to a wasm policy exposing the
+// entrypoint.
+func compilePolicy(t *testing.T, module string, entrypoint string) []byte {
+	t.Helper()
+
+	compiler := compile.New().
+		WithTarget(compile.TargetWasm).
+		WithEntrypoints(entrypoint).
+		WithBundle(&bundle.Bundle{
+			Modules: []bundle.ModuleFile{
+				{
+					Path:   "policy.rego",
+					URL:    "policy.rego",
+					Raw:    []byte(module),
+					Parsed: ast.MustParseModule(module),
+				},
+			},
+		})
+
+	if err := compiler.Build(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	return compiler.Bundle().WasmModules[0].Raw
+}
@@ -6,12 +6,17 @@ package opa
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"time"
 
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/types"
 )
 
-const PageSize = 65535
+const PageSize = 65536
 
 func Pages(n uint32) uint32 {
 	pages := n / PageSize
@@ -30,13 +35,13 @@ func (o *OPA) WithPolicyFile(fileName string) *OPA {
 		return o
 	}
 
-	o.policy = policy
+	o.policies = [][]byte{policy}
 	return o
 }
 
 // WithPolicyBytes configures the compiled policy to load.
 func (o *OPA) WithPolicyBytes(policy []byte) *OPA {
-	o.policy = policy
+	o.policies = [][]byte{policy}
 	return o
 }
 
@@ -105,8 +110,115 @@ func (o *OPA) WithPoolSize(size uint32) *OPA {
 	return o
 }
 
+// WithPoolMinSize configures the number of WASM instances built at
+// initialization, before any evaluation, and kept even if idle. The
+// default is a single one. It cannot exceed the pool size.
+func (o *OPA) WithPoolMinSize(size uint32) *OPA {
+	o.poolMinSize = size
+	return o
+}
+
+// WithPoolIdleTimeout configures the time after which the WASM instances
+// left idle are closed, down to the minimum pool size, to release their
+// memory. Zero never closes them, as by default, while any other timeout
+// is at least a millisecond.
+func (o *OPA) WithPoolIdleTimeout(timeout time.Duration) *OPA {
+	if timeout != 0 && timeout < time.Millisecond {
+		o.configErr = errors.New(errors.InvalidConfigErr, "pool idle timeout < 1ms")
+		return o
+	}
+
+	o.poolIdleTimeout = timeout
+	return o
+}
+
+// WithRecycling configures the WASM instances to be rebuilt after a
+// number of evaluations, or once their memory grew beyond a size in
+// bytes, to release the memory large inputs grew. The instances are
+// rebuilt in the background once released, the evaluations using the
+// others meanwhile. Zero disables either, as by default.
+func (o *OPA) WithRecycling(evals, memory uint32) *OPA {
+	o.recycleEvals, o.recycleMemory = evals, memory
+	return o
+}
+
 // WithErrorLogger configures an error logger invoked with all the errors.
 func (o *OPA) WithErrorLogger(logger func(error)) *OPA {
 	o.logError = logger
 	return o
 }
+
+// Engines to run the policies with. The wasmtime engine is available
+// only if built with the wasmtime tag, as it requires cgo.
+const (
+	EngineWazero   = "wazero"
+	EngineWasmtime = "wasmtime"
+)
+
+// WithEngine configures the Wasm engine running the policies. The
+// default is EngineWazero.
+func (o *OPA) WithEngine(engine string) *OPA {
+	for _, name := range wasm.Engines() {
+		if name == engine {
+			o.engine = engine
+			return o
+		}
+	}
+
+	o.configErr = errors.New(errors.InvalidConfigErr, fmt.Sprintf("engine %q not available, available: %v", engine, wasm.Engines()))
+	return o
+}
+
+// WithStrictBuiltinErrors configures whether errors raised by builtins,
+// such as a malformed argument, fail the evaluation with ErrBuiltin.
+// By default such a builtin call is undefined, as in a non-strict OPA
+// query.
+func (o *OPA) WithStrictBuiltinErrors(strict bool) *OPA {
+	o.strict = strict
+	return o
+}
+
+// WithBuiltin registers the Go implementation of a custom builtin the
+// policy has been compiled with, under the same name and declaration.
+// The builtins are dispatched to by every VM of the pool. As with the
+// OPA builtins, an error other than a topdown.Halt makes the call
+// undefined, unless in the strict builtin errors mode. The Wasm ABI
+// dispatches builtins of up to four arguments: a builtin taking more is
+// rejected with ErrInvalidConfig, as OPA does not compile calls to it.
+func (o *OPA) WithBuiltin(name string, decl *types.Function, impl topdown.BuiltinFunc) *OPA {
+	switch {
+	case name == "" || decl == nil || impl == nil:
+		o.configErr = errors.New(errors.InvalidConfigErr, fmt.Sprintf("builtin %q: missing name, declaration or implementation", name))
+		return o
+	case len(decl.FuncArgs().Args) > wasm.MaxBuiltinArgs:
+		o.configErr = errors.New(errors.InvalidConfigErr, fmt.Sprintf("builtin %q: more than %d arguments", name, wasm.MaxBuiltinArgs))
+		return o
+	}
+
+	if o.builtins == nil {
+		o.builtins = map[string]topdown.BuiltinFunc{}
+	}
+
+	o.builtins[name] = impl
+	return o
+}
+
+// BoolFallback defines how EvalBool handles a result that does not hold
+// exactly one boolean decision.
+type BoolFallback int
+
+const (
+	// FallbackError makes EvalBool return an error.
+	FallbackError BoolFallback = iota
+
+	// FallbackDeny makes EvalBool return false, without an error.
+	FallbackDeny
+)
+
+// WithBoolFallback configures how EvalBool handles undefined results,
+// non-boolean decisions and multiple results. The defaults are
+// FallbackDeny, FallbackError and FallbackError, respectively.
+func (o *OPA) WithBoolFallback(undefined, nonBoolean, multiple BoolFallback) *OPA {
+	o.boolUndefined, o.boolNonBoolean, o.boolMultiple = undefined, nonBoolean, multiple
+	return o
+}
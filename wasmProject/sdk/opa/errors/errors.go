@@ -27,6 +27,18 @@ const (
 
 	// CancelledErr is the error code returned if the evaluation is cancelled.
 	CancelledErr string = "cancelled"
+
+	// UndefinedErr is the error code returned if a decision is read from an undefined result.
+	UndefinedErr string = "undefined"
+
+	// InvalidResultErr is the error code returned if the result does not hold the expected decision.
+	InvalidResultErr string = "invalid_result"
+
+	// InvalidEntrypointErr is the error code returned if the policy does not export the entrypoint evaluated.
+	InvalidEntrypointErr string = "invalid_entrypoint"
+
+	// BuiltinErr is the error code returned if a built-in function halts the evaluation.
+	BuiltinErr string = "builtin_error"
 )
 
 // Error is the error code type returned by the SDK functions when an error occurs.
@@ -38,7 +50,8 @@ type Error struct {
 // New returns a new error with the passed code
 func New(code, msg string) error {
 	switch code {
-	case InvalidConfigErr, InvalidPolicyOrDataErr, InvalidBundleErr, NotReadyErr, InternalErr, CancelledErr:
+	case InvalidConfigErr, InvalidPolicyOrDataErr, InvalidBundleErr, NotReadyErr, InternalErr, CancelledErr, UndefinedErr, InvalidResultErr,
+		InvalidEntrypointErr, BuiltinErr:
 		return &Error{Code: code, Message: msg}
 	default:
 		panic("unknown error code: " + code)
@@ -59,6 +72,17 @@ func IsCancel(err error) bool {
 	return errorHasCode(err, CancelledErr)
 }
 
+// IsNotReady returns true if err was caused by the policy not being set,
+// or the instance closed.
+func IsNotReady(err error) bool {
+	return errorHasCode(err, NotReadyErr)
+}
+
+// IsUndefined returns true if err was caused by an undefined result.
+func IsUndefined(err error) bool {
+	return errorHasCode(err, UndefinedErr)
+}
+
 // Is allows matching error types using errors.Is (see IsCancel).
 func (e *Error) Is(target error) bool {
 	var t *Error
@@ -2,16 +2,16 @@
 // Use of this source code is governed by an Apache2
 // license that can be found in the LICENSE file.
 
-package http
+package loader
 
 import (
 	"math/rand"
 	"time"
 )
 
-// defaultBackoff returns a delay with an exponential backoff based on the
-// number of retries.
-func defaultBackoff(base, max float64, retries int) time.Duration {
+// Backoff returns a delay with an exponential backoff based on the
+// number of retries, for the loaders to retry with.
+func Backoff(base, max float64, retries int) time.Duration {
 	return backoff(base, max, .2, 1.6, retries)
 }
 
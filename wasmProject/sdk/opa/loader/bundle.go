@@ -0,0 +1,86 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package loader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// Snapshot returns the snapshot bundle to activate, out of a bundle
+// opened.
+func Snapshot(b *bundle.Bundle) Bundle {
+	s := Bundle{Revision: b.Manifest.Revision}
+	if b.Manifest.Roots != nil {
+		s.Roots = *b.Manifest.Roots
+	}
+
+	if b.Data != nil {
+		var v interface{} = b.Data
+		s.Data = &v
+	}
+
+	s.Policies = make([][]byte, len(b.WasmModules))
+	for i, m := range b.WasmModules {
+		s.Policies[i] = m.Raw
+	}
+
+	return s
+}
+
+// Patch applies the operations of a delta bundle to the data of the
+// target, as a single data patch: either all the operations are
+// applied, or none. An upsert sets the value, creating the missing
+// parents, while a replace or a remove requires the value to exist. It
+// returns ErrInvalidBundle if an operation is invalid, or the errors of
+// PatchData of the target.
+func Patch(ctx context.Context, t Target, patch bundle.Patch) error {
+	ops := make([]opa.PatchOp, len(patch.Data))
+	for i, op := range patch.Data {
+		path, ok := parsePatchPath(op.Path)
+		if !ok {
+			return errors.New(errors.InvalidBundleErr, fmt.Sprintf("invalid patch path %s", op.Path))
+		}
+
+		switch op.Op {
+		case "upsert":
+			ops[i] = opa.PatchOp{Op: opa.PatchAdd, Path: path, Value: op.Value}
+		case "replace":
+			ops[i] = opa.PatchOp{Op: opa.PatchReplace, Path: path, Value: op.Value}
+		case "remove":
+			ops[i] = opa.PatchOp{Op: opa.PatchRemove, Path: path}
+		default:
+			return errors.New(errors.InvalidBundleErr, fmt.Sprintf("invalid patch operation %s", op.Op))
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return t.PatchData(ctx, ops)
+}
+
+// parsePatchPath parses the JSON pointer of a patch operation. The data
+// root cannot be patched.
+func parsePatchPath(s string) ([]string, bool) {
+	path, ok := storage.ParsePathEscaped("/" + strings.Trim(s, "/"))
+	if !ok || len(path) == 0 {
+		return nil, false
+	}
+
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for i := range path {
+		path[i] = unescape.Replace(path[i])
+	}
+
+	return path, true
+}
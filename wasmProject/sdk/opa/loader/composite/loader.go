@@ -0,0 +1,234 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package composite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+)
+
+// Loader composes the bundles of several sources, e.g. a policy bundle
+// downloaded over HTTP and data bundles read from files, each source
+// activating its bundles through a loader of its own. The bundles own
+// their roots, as per their .manifest, or the top level keys of their
+// data without one: no two sources may own overlapping roots. Once every source activated a bundle, the policies
+// and the data of the bundles are merged and activated at once, and so
+// again whenever a source activates a bundle.
+type Loader struct {
+	configErr   error // Delayed configuration error, if any.
+	initialized bool
+	pd          loader.Target
+	sources     []*Source
+	active      bool // Set once the bundles of all the sources are activated.
+	monitor     loader.Monitor
+	mutex       sync.Mutex // Serializes the activations.
+}
+
+var _ loader.Loader = (*Loader)(nil)
+
+// New constructs a new composite loader, activating the bundles of its
+// sources in the target.
+func New(t loader.Target) *Loader {
+	return &Loader{pd: t}
+}
+
+// WithSource configures a source, with a name for the errors and the
+// status. The loader of the source is constructed by the function given,
+// to activate the bundles in the target given, as in:
+//
+//	WithSource("policy", func(t loader.Target) (loader.Loader, error) {
+//		return http.New(t).WithURL(url).Init()
+//	})
+//
+// The sources are merged in the order configured: the policies of the
+// first source come first.
+func (l *Loader) WithSource(name string, newLoader func(loader.Target) (loader.Loader, error)) *Loader {
+	for _, s := range l.sources {
+		if s.name == name {
+			l.configErr = errors.New(errors.InvalidConfigErr, fmt.Sprintf("duplicate source %s", name))
+			return l
+		}
+	}
+
+	s := &Source{composite: l, name: name}
+	ld, err := newLoader(s)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	s.loader = ld
+	l.sources = append(l.sources, s)
+	return l
+}
+
+// Init initializes the loader after its construction and
+// configuration. If invalid config, will return ErrInvalidConfig.
+func (l *Loader) Init() (*Loader, error) {
+	if l.configErr != nil {
+		return nil, l.configErr
+	}
+
+	if len(l.sources) == 0 {
+		return nil, errors.New(errors.InvalidConfigErr, "missing sources")
+	}
+
+	l.initialized = true
+	return l, nil
+}
+
+// Start starts the loaders of the sources, one after another, failing
+// if any fails to start. Once started, all the sources activated a
+// bundle.
+func (l *Loader) Start(ctx context.Context) error {
+	if !l.initialized {
+		return errors.New(errors.NotReadyErr, "")
+	}
+
+	for i, s := range l.sources {
+		if err := s.loader.Start(ctx); err != nil {
+			for _, started := range l.sources[:i] {
+				started.loader.Close()
+			}
+			return fmt.Errorf("source %s: %w", s.name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close stops the loaders of the sources.
+func (l *Loader) Close() {
+	if !l.initialized {
+		return
+	}
+
+	for _, s := range l.sources {
+		s.loader.Close()
+	}
+}
+
+// Load loads the bundles of all the sources, returning the first error.
+// The bundles are activated as loaded, once all the sources have one.
+func (l *Loader) Load(ctx context.Context) error {
+	if !l.initialized {
+		return errors.New(errors.NotReadyErr, "")
+	}
+
+	var err error
+	for _, s := range l.sources {
+		if e := s.loader.Load(ctx); e != nil && err == nil {
+			err = fmt.Errorf("source %s: %w", s.name, e)
+		}
+	}
+
+	if err != nil {
+		l.monitor.Failed(err)
+		return err
+	}
+
+	l.monitor.Succeeded()
+	return nil
+}
+
+// Status returns a snapshot of the status of the loader. The revision is
+// the revisions of the snapshot bundles of the sources, as in
+// policy=rev1,data=rev2. The failures include the ones of the loaders of
+// the sources, polling on their own: the last error is the one of the
+// last failure, and the consecutive failures the most of any source.
+func (l *Loader) Status() loader.Status {
+	status := l.monitor.Status()
+	for _, s := range l.sources {
+		source := s.loader.Status()
+		if source.ConsecutiveFailures > status.ConsecutiveFailures {
+			status.ConsecutiveFailures = source.ConsecutiveFailures
+		}
+
+		if source.LastFailure.After(status.LastFailure) {
+			status.LastFailure = source.LastFailure
+			status.LastError = fmt.Errorf("source %s: %w", s.name, source.LastError)
+		}
+	}
+
+	return status
+}
+
+// OnActivate registers a callback invoked with the status of the
+// loader once the bundles are activated. The callbacks run in the
+// loading goroutine, hence must not load.
+func (l *Loader) OnActivate(callback func(loader.Status)) {
+	l.monitor.OnActivate(callback)
+}
+
+// Sources returns the status of the loaders of the sources, by name.
+func (l *Loader) Sources() map[string]loader.Status {
+	sources := make(map[string]loader.Status, len(l.sources))
+	for _, s := range l.sources {
+		sources[s.name] = s.loader.Status()
+	}
+	return sources
+}
+
+// activate merges and activates the bundles of the sources, if all
+// have one. Called with the mutex held.
+func (l *Loader) activate(ctx context.Context) error {
+	for _, s := range l.sources {
+		if !s.installed {
+			return nil
+		}
+	}
+
+	var policies [][]byte
+	var data interface{} = map[string]interface{}{}
+	revisions := make([]string, len(l.sources))
+	for i, s := range l.sources {
+		policies = append(policies, s.policies...)
+		if s.data != nil {
+			data = merge(data, s.data)
+		}
+		revisions[i] = s.name + "=" + s.revision
+	}
+
+	if err := l.pd.SetPoliciesData(ctx, policies, &data); err != nil {
+		return err
+	}
+
+	l.active = true
+	l.monitor.Activated(strings.Join(revisions, ","), "")
+	return nil
+}
+
+// merge merges the documents, the second taking precedence but for the
+// objects, merged recursively. The documents are not modified.
+func merge(a, b interface{}) interface{} {
+	am, ok := a.(map[string]interface{})
+	if !ok {
+		return b
+	}
+
+	bm, ok := b.(map[string]interface{})
+	if !ok {
+		return b
+	}
+
+	m := make(map[string]interface{}, len(am)+len(bm))
+	for k, v := range am {
+		m[k] = v
+	}
+
+	for k, v := range bm {
+		if prev, ok := m[k]; ok {
+			v = merge(prev, v)
+		}
+		m[k] = v
+	}
+
+	return m
+}
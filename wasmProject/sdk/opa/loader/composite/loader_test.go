@@ -0,0 +1,410 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build opa_wasm
+// +build opa_wasm
+
+package composite
+
+import (
+	"bytes"
+	"context"
+	goerrors "errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader/file"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader/internal/loadertest"
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+func TestCompositeLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-composite-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.tar.gz")
+	dataFile := filepath.Join(dir, "data.tar.gz")
+	writeBundle(policyFile, "r1", []string{"p"}, "wasm-policy", map[string]interface{}{
+		"p": map[string]interface{}{"x": "1"},
+	})
+	writeBundle(dataFile, "r2", []string{"d"}, "", map[string]interface{}{
+		"d": map[string]interface{}{"y": "2"},
+	})
+
+	var pd testPolicyData
+	l, err := New(&pd).
+		WithSource("policy", fileSource(policyFile)).
+		WithSource("data", fileSource(dataFile)).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var activations []loader.Status
+	l.OnActivate(func(s loader.Status) {
+		activations = append(activations, s)
+	})
+
+	ctx := context.Background()
+	if err := l.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var data interface{} = map[string]interface{}{
+		"p": map[string]interface{}{"x": "1"},
+		"d": map[string]interface{}{"y": "2"},
+	}
+	pd.Check(t, []string{"wasm-policy"}, data)
+
+	if pd.sets != 1 || len(activations) != 1 {
+		t.Fatalf("expected a single activation, got %d (%d callbacks)", pd.sets, len(activations))
+	}
+
+	if rev := l.Status().Revision; rev != "policy=r1,data=r2" {
+		t.Fatalf("unexpected revision %s", rev)
+	}
+
+	// Reload with the data bundle updated only.
+
+	writeBundle(dataFile, "r3", []string{"d"}, "", map[string]interface{}{
+		"d": map[string]interface{}{"y": "3"},
+	})
+
+	if err := l.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data = map[string]interface{}{
+		"p": map[string]interface{}{"x": "1"},
+		"d": map[string]interface{}{"y": "3"},
+	}
+	pd.Check(t, []string{"wasm-policy"}, data)
+
+	if rev := l.Status().Revision; rev != "policy=r1,data=r3" {
+		t.Fatalf("unexpected revision %s", rev)
+	}
+
+	// Patch the data of a source, within and outside of its roots.
+
+	source := l.sources[1]
+	if err := source.SetDataPath(ctx, []string{"d", "z"}, "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	data = map[string]interface{}{
+		"p": map[string]interface{}{"x": "1"},
+		"d": map[string]interface{}{"y": "3", "z": "4"},
+	}
+	pd.Check(t, []string{"wasm-policy"}, data)
+
+	if err := source.SetDataPath(ctx, []string{"p", "z"}, "4"); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got %v", err)
+	}
+
+	// The failures of the sources polling are reported.
+
+	if err := ioutil.WriteFile(dataFile, []byte("invalid"), 0644); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := source.loader.Load(ctx); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	status := l.Status()
+	if !goerrors.Is(status.LastError, &errors.Error{Code: errors.InvalidBundleErr}) || status.ConsecutiveFailures != 2 {
+		t.Fatalf("expected 2 invalid bundle errors, got %v (%d)", status.LastError, status.ConsecutiveFailures)
+	}
+
+	if rev := status.Revision; rev != "policy=r1,data=r3" {
+		t.Fatalf("unexpected revision %s", rev)
+	}
+}
+
+func TestCompositeLoaderOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-composite-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.tar.gz")
+	dataFile := filepath.Join(dir, "data.tar.gz")
+	writeBundle(policyFile, "r1", []string{"p"}, "wasm-policy", map[string]interface{}{})
+	writeBundle(dataFile, "r2", []string{"p/q"}, "", map[string]interface{}{})
+
+	var pd testPolicyData
+	l, err := New(&pd).
+		WithSource("policy", fileSource(policyFile)).
+		WithSource("data", fileSource(dataFile)).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got %v", err)
+	}
+
+	if pd.sets != 0 {
+		t.Fatal("bundles with overlapping roots activated")
+	}
+
+	if _, err := New(&pd).WithSource("a", fileSource(policyFile)).WithSource("a", fileSource(dataFile)).Init(); !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("expected invalid config error, got %v", err)
+	}
+}
+
+func TestCompositeLoaderDataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-composite-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// A data bundle is activated in a composite loader only.
+
+	dataFile := filepath.Join(dir, "data.tar.gz")
+	writeBundle(dataFile, "r1", []string{"d"}, "", map[string]interface{}{})
+
+	var pd testPolicyData
+	l, err := fileSource(dataFile)(&pd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got %v", err)
+	}
+}
+
+func TestCompositeLoaderPatchInactive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-composite-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.tar.gz")
+	dataFile := filepath.Join(dir, "data.tar.gz")
+	writeBundle(policyFile, "r1", []string{"p"}, "wasm-policy", map[string]interface{}{
+		"p": map[string]interface{}{"x": "1"},
+	})
+
+	var pd testPolicyData
+	l, err := New(&pd).
+		WithSource("policy", fileSource(policyFile)).
+		WithSource("data", fileSource(dataFile)).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	source := l.sources[0]
+	if err := source.loader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not active yet, the operations are checked as once active.
+
+	for _, ops := range [][]opa.PatchOp{
+		{{Op: opa.PatchReplace, Path: []string{"p", "y"}, Value: "2"}},
+		{{Op: opa.PatchRemove, Path: []string{"p", "y"}}},
+		{{Op: opa.PatchAdd, Path: []string{"p", "x", "y"}, Value: "2"}},
+		{{Op: opa.PatchAdd, Path: []string{"p", "y"}, Value: "2"}, {Op: "move", Path: []string{"p", "x"}}},
+	} {
+		if err := source.PatchData(ctx, ops); !goerrors.Is(err, &errors.Error{Code: errors.InvalidPolicyOrDataErr}) {
+			t.Fatalf("expected invalid policy or data error, got %v", err)
+		}
+	}
+
+	if err := source.PatchData(ctx, []opa.PatchOp{
+		{Op: opa.PatchReplace, Path: []string{"p", "x"}, Value: "2"},
+		{Op: opa.PatchAdd, Path: []string{"p", "z"}, Value: "3"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeBundle(dataFile, "r2", []string{"d"}, "", map[string]interface{}{})
+	if err := l.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var data interface{} = map[string]interface{}{
+		"p": map[string]interface{}{"x": "2", "z": "3"},
+	}
+	pd.Check(t, []string{"wasm-policy"}, data)
+}
+
+func TestCompositeLoaderDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-composite-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.tar.gz")
+	writeBundle(policyFile, "r1", []string{"p"}, "wasm-policy", map[string]interface{}{})
+
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "data.json"), []byte(`{"d": {"y": "2"}}`), 0644); err != nil {
+		panic(err)
+	}
+
+	// Without a .manifest, the data directory owns the top level keys
+	// of its data.
+
+	var pd testPolicyData
+	l, err := New(&pd).
+		WithSource("policy", fileSource(policyFile)).
+		WithSource("data", fileSource(dataDir)).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := l.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var data interface{} = map[string]interface{}{
+		"d": map[string]interface{}{"y": "2"},
+	}
+	pd.Check(t, []string{"wasm-policy"}, data)
+
+	source := l.sources[1]
+	if err := source.SetDataPath(ctx, []string{"e"}, "3"); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got %v", err)
+	}
+
+	// Policies without a .manifest are not attributable to roots.
+
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "policy.wasm"), []byte("wasm-policy-d"), 0644); err != nil {
+		panic(err)
+	}
+
+	if err := source.loader.Load(ctx); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dataDir, ".manifest"), []byte(`{"roots": ["d"]}`), 0644); err != nil {
+		panic(err)
+	}
+
+	if err := source.loader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pd.Check(t, []string{"wasm-policy", "wasm-policy-d"}, data)
+}
+
+func fileSource(filename string) func(loader.Target) (loader.Loader, error) {
+	return func(t loader.Target) (loader.Loader, error) {
+		return file.New(t).WithFile(filename).Init()
+	}
+}
+
+type testPolicyData struct {
+	sync.Mutex
+	policies [][]byte
+	data     interface{}
+	sets     int // Number of SetPoliciesData calls.
+}
+
+func (pd *testPolicyData) SetPoliciesData(_ context.Context, policies [][]byte, data *interface{}) error {
+	pd.Lock()
+	defer pd.Unlock()
+
+	pd.policies = policies
+	pd.data = *data
+	pd.sets++
+	return nil
+}
+
+func (pd *testPolicyData) SetDataPath(ctx context.Context, path []string, value interface{}) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchAdd, Path: path, Value: value}})
+}
+
+func (pd *testPolicyData) RemoveDataPath(ctx context.Context, path []string) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchRemove, Path: path}})
+}
+
+func (pd *testPolicyData) PatchData(_ context.Context, ops []opa.PatchOp) error {
+	pd.Lock()
+	defer pd.Unlock()
+
+	data, err := loadertest.PatchData(pd.data, ops)
+	if err != nil {
+		return err
+	}
+
+	pd.data = data
+	return nil
+}
+
+func (pd *testPolicyData) Check(t *testing.T, policies []string, data interface{}) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	if len(policies) != len(pd.policies) {
+		t.Fatalf("policy modules mismatch: %d, expected %d", len(pd.policies), len(policies))
+	}
+
+	for i, policy := range policies {
+		if !bytes.Equal([]byte(policy), pd.policies[i]) {
+			t.Fatalf("policy module %d mismatch", i)
+		}
+	}
+
+	if !reflect.DeepEqual(data, pd.data) {
+		t.Fatalf("expected data %v, got %v", data, pd.data)
+	}
+}
+
+func writeBundle(name string, revision string, roots []string, policy string, data map[string]interface{}) {
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: revision, Roots: &roots},
+		Data:     data,
+	}
+
+	if policy != "" {
+		b.WasmModules = []bundle.WasmModuleFile{{
+			URL:  "/policy.wasm",
+			Path: "/policy.wasm",
+			Raw:  []byte(policy),
+		}}
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, b); err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package composite
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+// Source is the target the loader of a source activates its bundles
+// in. It checks the roots of the bundles against the ones of the other
+// sources, before activating the bundles of all the sources merged.
+type Source struct {
+	composite *Loader
+	name      string
+	loader    loader.Loader
+	installed bool // Set once a snapshot bundle is activated.
+	revision  string
+	roots     []string
+	policies  [][]byte
+	data      interface{}
+}
+
+var _ loader.BundleTarget = (*Source)(nil)
+
+// SetBundle activates a snapshot bundle of the source, with the bundles
+// of the other sources. It returns ErrInvalidBundle if the roots of the
+// bundle overlap with the ones of another source. A bundle without
+// roots, having no .manifest, owns the top level keys of its data, or
+// all the roots if the only source: its policies are not attributable
+// to roots otherwise.
+func (s *Source) SetBundle(ctx context.Context, b loader.Bundle) error {
+	c := s.composite
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	roots := b.Roots
+	if roots == nil && len(c.sources) > 1 {
+		if len(b.Policies) > 0 {
+			return errors.New(errors.InvalidBundleErr, fmt.Sprintf("source %s: policies without .manifest roots", s.name))
+		}
+		roots = dataRoots(b.Data)
+	}
+	roots = normalizeRoots(roots)
+	for _, other := range c.sources {
+		if other == s || !other.installed {
+			continue
+		}
+
+		for _, root := range roots {
+			for _, otherRoot := range other.roots {
+				if bundle.RootPathsOverlap(root, otherRoot) {
+					return errors.New(errors.InvalidBundleErr, fmt.Sprintf("source %s: root %q overlaps with root %q of source %s", s.name, root, otherRoot, other.name))
+				}
+			}
+		}
+	}
+
+	var data interface{}
+	if b.Data != nil {
+		data = *b.Data
+	}
+
+	prev := *s
+	s.installed, s.revision, s.roots, s.policies, s.data = true, b.Revision, roots, b.Policies, data
+
+	if err := c.activate(ctx); err != nil {
+		*s = prev
+		return err
+	}
+
+	return nil
+}
+
+// SetPoliciesData activates the policies and data of a bundle without
+// roots, see SetBundle.
+func (s *Source) SetPoliciesData(ctx context.Context, policies [][]byte, data *interface{}) error {
+	return s.SetBundle(ctx, loader.Bundle{Policies: policies, Data: data})
+}
+
+// SetDataPath sets the data of the source at the path, which must be
+// within its roots.
+func (s *Source) SetDataPath(ctx context.Context, path []string, value interface{}) error {
+	return s.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchAdd, Path: path, Value: value}})
+}
+
+// RemoveDataPath removes the data of the source at the path, which must
+// be within its roots.
+func (s *Source) RemoveDataPath(ctx context.Context, path []string) error {
+	return s.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchRemove, Path: path}})
+}
+
+// PatchData patches the data of the source, the paths of the operations
+// being within its roots, and the data active if the bundles of all the
+// sources are. The operations are checked as by PatchData of OPA, even
+// if not active yet. Either all the operations are applied, or none.
+func (s *Source) PatchData(ctx context.Context, ops []opa.PatchOp) error {
+	c := s.composite
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !s.installed {
+		return errors.New(errors.InvalidBundleErr, fmt.Sprintf("source %s: no snapshot bundle activated", s.name))
+	}
+
+	patch := make([]wasm.PatchOp, len(ops))
+	for i, op := range ops {
+		if !bundle.RootPathsContain(s.roots, strings.Join(op.Path, "/")) {
+			return errors.New(errors.InvalidBundleErr, fmt.Sprintf("source %s: path %s not within the roots", s.name, strings.Join(op.Path, "/")))
+		}
+		patch[i] = wasm.PatchOp{Op: op.Op, Path: op.Path, Value: op.Value}
+	}
+
+	data, err := wasm.ApplyPatch(s.data, patch)
+	if err != nil {
+		return errors.New(errors.InvalidPolicyOrDataErr, fmt.Sprintf("source %s: %v", s.name, err))
+	}
+
+	if c.active {
+		if err := c.pd.PatchData(ctx, ops); err != nil {
+			return err
+		}
+	}
+
+	s.data = data
+	return nil
+}
+
+// dataRoots returns the top level keys of the data, sorted.
+func dataRoots(data *interface{}) []string {
+	roots := []string{}
+	if data == nil {
+		return roots
+	}
+
+	obj, _ := (*data).(map[string]interface{})
+	for k := range obj {
+		roots = append(roots, k)
+	}
+
+	sort.Strings(roots)
+	return roots
+}
+
+// normalizeRoots trims the slashes of the roots. Nil roots own all.
+func normalizeRoots(roots []string) []string {
+	if roots == nil {
+		return []string{""}
+	}
+
+	normalized := make([]string, len(roots))
+	for i, root := range roots {
+		normalized[i] = strings.Trim(root, "/")
+	}
+	return normalized
+}
@@ -8,9 +8,13 @@ import (
 	"time"
 
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/open-policy-agent/opa/bundle"
 )
 
-// WithFile configures the file to load the bundle from.
+// WithFile configures the file to load the bundle from. If a
+// directory, the bundle consists of its .wasm files, sorted by name,
+// and its data.json file.
 func (l *Loader) WithFile(filename string) *Loader {
 	l.filename = filename
 	return l
@@ -22,6 +26,20 @@ func (l *Loader) WithInterval(interval time.Duration) *Loader {
 	return l
 }
 
+// WithWatch configures the watch mode: instead of reloading the bundle
+// periodically, the loader watches its files and reloads it once they
+// changed, waiting for the changes to settle for the debounce delay.
+func (l *Loader) WithWatch(debounce time.Duration) *Loader {
+	if debounce < 0 {
+		l.configErr = errors.New(errors.InvalidConfigErr, "negative debounce")
+		return l
+	}
+
+	l.watch = true
+	l.debounce = debounce
+	return l
+}
+
 // WithErrorLogger configures an error logger invoked with all the errors.
 func (l *Loader) WithErrorLogger(logger func(error)) *Loader {
 	if logger == nil {
@@ -32,3 +50,32 @@ func (l *Loader) WithErrorLogger(logger func(error)) *Loader {
 	l.logError = logger
 	return l
 }
+
+// WithVerificationKey configures the key to verify the bundle signatures
+// with: a PEM encoded public key (e.g. RS256, ES256) or the secret of an
+// HMAC algorithm (e.g. HS256). The algorithm defaults to RS256. Unsigned
+// bundles, or bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationKey(keyID, key, alg string) *Loader {
+	config, err := loader.VerificationKey(keyID, key, alg)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
+
+// WithVerificationConfig configures the verification of the bundle
+// signatures, as in the OPA bundle configuration. Unsigned bundles, or
+// bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationConfig(config *bundle.VerificationConfig) *Loader {
+	config, err := loader.VerificationConfig(config)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
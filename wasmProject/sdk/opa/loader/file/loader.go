@@ -5,54 +5,79 @@
 package file
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/util"
 
-	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
 )
 
 const (
 	// DefaultInterval for re-loading the bundle file.
 	DefaultInterval = time.Minute
+
+	// DefaultDebounce is the default delay the watch mode waits for
+	// the changes to settle before reloading.
+	DefaultDebounce = 100 * time.Millisecond
+
+	// dataFile is the data file of a bundle directory.
+	dataFile = "data.json"
+
+	// manifestFile is the optional manifest of a bundle directory.
+	manifestFile = ".manifest"
 )
 
 var errNotReady = errors.New(errors.NotReadyErr, "")
 
-// Loader loads a bundle from a file. If started, it loads the bundle
-// periodically until closed.
+// Loader loads a bundle from a file, or from a directory of .wasm
+// files, a data.json file and a .manifest file, all optional. If
+// started, it loads the bundle
+// periodically, or as the files change in the watch mode, until
+// closed.
 type Loader struct {
-	configErr   error // Delayed configuration error, if any.
-	initialized bool
-	pd          policyData
-	filename    string
-	interval    time.Duration
-	closing     chan struct{} // Signal the request to stop the poller.
-	closed      chan struct{} // Signals the successful stopping of the poller.
-	logError    func(error)
-	mutex       sync.Mutex
+	configErr    error // Delayed configuration error, if any.
+	initialized  bool
+	pd           loader.Target
+	filename     string
+	interval     time.Duration
+	watch        bool          // Watch mode, instead of the periodic loading.
+	debounce     time.Duration // Watch mode delay for the changes to settle.
+	closing      chan struct{} // Signal the request to stop the poller.
+	closed       chan struct{} // Signals the successful stopping of the poller.
+	logError     func(error)
+	verification *bundle.VerificationConfig // Bundle signature verification, if any.
+	installed    bool                       // Set once a snapshot bundle is installed.
+	hash         []byte                     // Hash of the contents installed last.
+	monitor      loader.Monitor
+	mutex        sync.Mutex
 }
 
-// policyData captures the functions used in setting the policy and data.
-type policyData interface {
-	SetPolicyData(ctx context.Context, policy []byte, data *interface{}) error
-}
+var _ loader.Loader = (*Loader)(nil)
 
 // New constructs a new file loader periodically reloading the bundle
-// from a file.
-func New(opa *opa.OPA) *Loader {
-	return new(opa)
+// from a file, activating it in the target: an OPA instance, or a
+// source of a composite loader.
+func New(t loader.Target) *Loader {
+	return new(t)
 }
 
 // new constructs a new file loader. This is for tests.
-func new(pd policyData) *Loader {
+func new(pd loader.Target) *Loader {
 	return &Loader{
 		pd:       pd,
 		interval: DefaultInterval,
+		debounce: DefaultDebounce,
 		logError: func(error) {},
 	}
 }
@@ -73,7 +98,8 @@ func (l *Loader) Init() (*Loader, error) {
 }
 
 // Start starts the periodic loading byt calling Load, failing if the
-// bundle loading fails.
+// bundle loading fails. In the watch mode, it loads the bundle as its
+// files change instead.
 func (l *Loader) Start(ctx context.Context) error {
 	if !l.initialized {
 		return errNotReady
@@ -83,10 +109,22 @@ func (l *Loader) Start(ctx context.Context) error {
 		return err
 	}
 
+	var w *watcher
+	if l.watch {
+		var err error
+		if w, err = newWatcher(l.filename); err != nil {
+			return errors.New(errors.InternalErr, err.Error())
+		}
+	}
+
 	l.closing = make(chan struct{})
 	l.closed = make(chan struct{})
 
-	go l.poller()
+	if w != nil {
+		go l.watcher(w)
+	} else {
+		go l.poller()
+	}
 
 	return nil
 }
@@ -108,10 +146,26 @@ func (l *Loader) Close() {
 	l.closed = nil
 }
 
+// Status returns a snapshot of the status of the loader. The revision
+// of a bundle directory is the one of its .manifest, if any. The ETag
+// is empty.
+func (l *Loader) Status() loader.Status {
+	return l.monitor.Status()
+}
+
+// OnActivate registers a callback invoked with the status of the
+// loader once a bundle is activated. The callbacks run in the loading
+// goroutine, hence must not load.
+func (l *Loader) OnActivate(callback func(loader.Status)) {
+	l.monitor.OnActivate(callback)
+}
+
 // Load loads the bundle from a file and installs it. The possible
 // returned errors are ErrInvalidBundle (in case of an error in
-// loading or opening the bundle) and the ones SetPolicyData of OPA
-// returns.
+// loading or opening the bundle) and the ones SetPoliciesData of OPA
+// returns. All the wasm modules of the bundle are installed. A delta
+// bundle patches the data installed instead, as a single data
+// revision, see PatchData of OPA for the errors then.
 func (l *Loader) Load(ctx context.Context) error {
 	if !l.initialized {
 		return errNotReady
@@ -120,31 +174,158 @@ func (l *Loader) Load(ctx context.Context) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	f, err := os.Open(l.filename)
+	if err := l.load(ctx); err != nil {
+		l.monitor.Failed(err)
+		return err
+	}
+
+	l.monitor.Succeeded()
+	return nil
+}
+
+// load loads the bundle and installs it, if changed.
+func (l *Loader) load(ctx context.Context) error {
+	files, err := readFiles(l.filename)
 	if err != nil {
 		return errors.New(errors.InvalidBundleErr, err.Error())
 	}
 
-	defer f.Close()
+	// Skip the parsing and installing if nothing changed.
+	hash := hashFiles(files)
+	if bytes.Equal(hash, l.hash) {
+		return nil
+	}
+
+	var b bundle.Bundle
+	if raw, ok := files[""]; ok {
+		read, err := loader.ReadBundle(raw, l.verification)
+		if err != nil {
+			return err
+		}
+		b = *read
+	} else if l.verification != nil {
+		return errors.New(errors.InvalidBundleErr, "bundle directories are not signed")
+	} else if b, err = dirBundle(files); err != nil {
+		return errors.New(errors.InvalidBundleErr, err.Error())
+	}
 
-	// TODO: Cut the dependency to the OPA bundle package.
+	if b.Type() == bundle.DeltaBundleType {
+		if !l.installed {
+			return errors.New(errors.InvalidBundleErr, "delta bundle without a snapshot bundle installed")
+		}
+
+		if err := loader.Patch(ctx, l.pd, b.Patch); err != nil {
+			return err
+		}
+
+		l.hash = hash
+		l.monitor.Activated(b.Manifest.Revision, "")
+		return nil
+	}
+
+	if err := loader.Activate(ctx, l.pd, loader.Snapshot(&b)); err != nil {
+		return err
+	}
 
-	b, err := bundle.NewReader(f).Read()
+	l.installed = true
+	l.hash = hash
+	l.monitor.Activated(b.Manifest.Revision, "")
+	return nil
+}
+
+// readFiles reads the bundle file, returned under the empty name, or
+// the .wasm files, the data file and the manifest of the bundle
+// directory, by name.
+func readFiles(filename string) (map[string][]byte, error) {
+	info, err := os.Stat(filename)
 	if err != nil {
-		return errors.New(errors.InvalidBundleErr, err.Error())
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{"": raw}, nil
+	}
+
+	entries, err := ioutil.ReadDir(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() || !isBundleFile(entry.Name()) {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(filename, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = raw
 	}
 
-	if len(b.WasmModules) == 0 {
-		return errors.New(errors.InvalidBundleErr, "missing wasm")
+	return files, nil
+}
+
+// isBundleFile returns true if the file is part of a bundle directory.
+func isBundleFile(name string) bool {
+	return name == dataFile || name == manifestFile || filepath.Ext(name) == ".wasm"
+}
+
+// hashFiles hashes the names and contents of the files.
+func hashFiles(files map[string][]byte) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	var data *interface{}
-	if b.Data != nil {
-		var v interface{} = b.Data
-		data = &v
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(files[name]))
+		h.Write(files[name])
+	}
+	return h.Sum(nil)
+}
+
+// dirBundle constructs the bundle of a directory from its files, the
+// .wasm files sorted by name. Without a manifest, the bundle has no
+// roots.
+func dirBundle(files map[string][]byte) (bundle.Bundle, error) {
+	var b bundle.Bundle
+	if raw, ok := files[dataFile]; ok {
+		if err := util.UnmarshalJSON(raw, &b.Data); err != nil {
+			return b, fmt.Errorf("%s: %w", dataFile, err)
+		}
+	}
+
+	if raw, ok := files[manifestFile]; ok {
+		if err := util.UnmarshalJSON(raw, &b.Manifest); err != nil {
+			return b, fmt.Errorf("%s: %w", manifestFile, err)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != dataFile && name != manifestFile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.WasmModules = append(b.WasmModules, bundle.WasmModuleFile{
+			URL:  "/" + name,
+			Path: "/" + name,
+			Raw:  files[name],
+		})
 	}
 
-	return l.pd.SetPolicyData(ctx, b.WasmModules[0].Raw, data)
+	return b, nil
 }
 
 // poller periodically downloads the bundle.
@@ -9,13 +9,19 @@ package file
 import (
 	"bytes"
 	"context"
+	goerrors "errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader/internal/loadertest"
 	"github.com/open-policy-agent/opa/bundle"
 )
 
@@ -64,53 +70,449 @@ func TestFileLoader(t *testing.T) {
 		"bar": "foo",
 	}
 
+	sets := pd.Sets()
 	writeBundle(f.Name(), policy, data)
 
-	pd.WaitUpdate()
+	pd.WaitUpdate(sets)
 	pd.CheckEqual(t, policy, &data)
 
 	loader.Close()
 }
 
+func TestFileLoaderModules(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-file-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	policies := []string{"wasm-policy-a", "wasm-policy-b"}
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+
+	b := bundle.Bundle{
+		Data: data.(map[string]interface{}),
+		WasmModules: []bundle.WasmModuleFile{
+			{URL: "/a/policy.wasm", Path: "/a/policy.wasm", Raw: []byte(policies[0])},
+			{URL: "/b/policy.wasm", Path: "/b/policy.wasm", Raw: []byte(policies[1])},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, b); err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+
+	var pd testPolicyData
+	loader, err := new(&pd).WithFile(f.Name()).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	pd.CheckModules(t, policies, &data)
+}
+
+func TestFileLoaderVerification(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-file-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+
+	signed := bundle.Bundle{
+		Data:        data.(map[string]interface{}),
+		WasmModules: []bundle.WasmModuleFile{{URL: "/policy.wasm", Path: "/policy.wasm", Raw: []byte("wasm-policy")}},
+	}
+	if err := signed.GenerateSignature(bundle.NewSigningConfig("secret", "HS256", ""), "foo", false); err != nil {
+		panic(err)
+	}
+
+	tampered := signed
+	tampered.WasmModules = []bundle.WasmModuleFile{{URL: "/policy.wasm", Path: "/policy.wasm", Raw: []byte("wasm-policy-tampered")}}
+
+	unsigned := signed
+	unsigned.Signatures = bundle.SignaturesConfig{}
+
+	tests := []struct {
+		note   string
+		bundle bundle.Bundle
+		key    string
+		valid  bool
+	}{
+		{"signed", signed, "secret", true},
+		{"wrong key", signed, "other", false},
+		{"tampered", tampered, "secret", false},
+		{"unsigned", unsigned, "secret", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.note, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := bundle.NewWriter(&buf).Write(test.bundle); err != nil {
+				panic(err)
+			}
+
+			if err := ioutil.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
+				panic(err)
+			}
+
+			var pd testPolicyData
+			loader, err := new(&pd).WithFile(f.Name()).WithVerificationKey("foo", test.key, "HS256").Init()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			err = loader.Load(context.Background())
+			if test.valid && err != nil {
+				t.Fatalf("unable to load: %v", err)
+			} else if !test.valid && !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+				t.Fatalf("expected invalid bundle error, got: %v", err)
+			}
+		})
+	}
+
+	// Without a key ID, the signatures are required nevertheless.
+
+	var pd testPolicyData
+	config := bundle.NewVerificationConfig(map[string]*bundle.KeyConfig{"foo": {Key: "secret", Algorithm: "HS256"}}, "", "", nil)
+	loader, err := new(&pd).WithFile(f.Name()).WithVerificationConfig(config).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got: %v", err)
+	}
+
+	if _, err := new(&pd).WithFile(f.Name()).WithVerificationKey("foo", "secret", "XX256").Init(); !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("expected invalid config error, got: %v", err)
+	}
+}
+
+func TestFileLoaderDelta(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-file-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	write := func(b bundle.Bundle) {
+		var buf bytes.Buffer
+		if err := bundle.NewWriter(&buf).Write(b); err != nil {
+			panic(err)
+		}
+
+		if err := ioutil.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	delta := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "delta"},
+		Patch: bundle.Patch{Data: []bundle.PatchOperation{
+			{Op: "upsert", Path: "/a/b", Value: "c"},
+			{Op: "replace", Path: "foo", Value: "baz"},
+			{Op: "remove", Path: "/x~1y"},
+		}},
+	}
+
+	var pd testPolicyData
+	loader, err := new(&pd).WithFile(f.Name()).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Delta bundles patch the data of a snapshot bundle.
+
+	write(delta)
+	if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got: %v", err)
+	}
+
+	write(bundle.Bundle{
+		Data: map[string]interface{}{"foo": "bar", "x/y": true},
+		Wasm: []byte("wasm-policy"),
+	})
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	write(delta)
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	var expected interface{} = map[string]interface{}{
+		"a":   map[string]interface{}{"b": "c"},
+		"foo": "baz",
+	}
+	pd.Lock()
+	data := *pd.data
+	pd.Unlock()
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected data %v, got %v", expected, data)
+	}
+
+	// Invalid operations are rejected before any is applied.
+
+	write(bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "delta"},
+		Patch: bundle.Patch{Data: []bundle.PatchOperation{
+			{Op: "upsert", Path: "/foo", Value: "qux"},
+			{Op: "move", Path: "/a"},
+		}},
+	})
+	if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got: %v", err)
+	}
+
+	pd.Lock()
+	data = *pd.data
+	pd.Unlock()
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected data %v, got %v", expected, data)
+	}
+
+	// The operations are applied as one: either all, or none.
+
+	write(bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "delta"},
+		Patch: bundle.Patch{Data: []bundle.PatchOperation{
+			{Op: "upsert", Path: "/foo", Value: "qux"},
+			{Op: "replace", Path: "/missing", Value: "qux"},
+		}},
+	})
+	if err := loader.Load(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	pd.Lock()
+	data = *pd.data
+	pd.Unlock()
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected data %v, got %v", expected, data)
+	}
+}
+
+func TestFileLoaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-file-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "bundle.tar.gz")
+	writeBundle(filename, "wasm-policy", map[string]interface{}{"foo": "bar"})
+
+	var pd testPolicyData
+	loader, err := new(&pd).WithFile(filename).WithInterval(time.Hour).WithWatch(10 * time.Millisecond).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	defer loader.Close()
+
+	// Replace the file, as deployment tools do, with a rename.
+
+	policy := "wasm-policy-modified"
+	var data interface{} = map[string]interface{}{
+		"bar": "foo",
+	}
+
+	sets := pd.Sets()
+	writeBundle(filepath.Join(dir, "bundle.tmp"), policy, data)
+	if err := os.Rename(filepath.Join(dir, "bundle.tmp"), filename); err != nil {
+		panic(err)
+	}
+
+	pd.WaitUpdate(sets)
+	pd.CheckEqual(t, policy, &data)
+}
+
+func TestFileLoaderDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-file-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	write("b.wasm", "wasm-policy-b")
+	write("a.wasm", "wasm-policy-a")
+	write("data.json", `{"foo": "bar"}`)
+	write("README", "not part of the bundle")
+
+	var pd testPolicyData
+	loader, err := new(&pd).WithFile(dir).WithWatch(10 * time.Millisecond).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	defer loader.Close()
+
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+	pd.CheckModules(t, []string{"wasm-policy-a", "wasm-policy-b"}, &data)
+
+	// Unchanged contents are not installed again.
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if sets := pd.Sets(); sets != 1 {
+		t.Fatalf("expected the bundle installed once, got %d", sets)
+	}
+
+	// A change of the data is watched for.
+
+	write("data.json", `{"bar": "foo"}`)
+	pd.WaitUpdate(1)
+
+	data = map[string]interface{}{
+		"bar": "foo",
+	}
+	pd.Lock()
+	got := *pd.data
+	pd.Unlock()
+	if !reflect.DeepEqual(got, data) {
+		t.Fatalf("expected data %v, got %v", data, got)
+	}
+
+	// The revision is the one of the .manifest, if any.
+
+	write(".manifest", `{"revision": "r1", "roots": ["bar"]}`)
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if rev := loader.Status().Revision; rev != "r1" {
+		t.Fatalf("expected revision r1, got %q", rev)
+	}
+}
+
 type testPolicyData struct {
 	sync.Mutex
-	policy  []byte
-	data    *interface{}
-	updated chan struct{}
+	policies [][]byte
+	data     *interface{}
+	sets     int // Number of SetPoliciesData calls.
+	updated  chan struct{}
 }
 
-func (pd *testPolicyData) SetPolicyData(_ context.Context, policy []byte, data *interface{}) error {
+func (pd *testPolicyData) SetPoliciesData(_ context.Context, policies [][]byte, data *interface{}) error {
 	pd.Lock()
 	defer pd.Unlock()
 
-	pd.policy = policy
+	pd.policies = policies
 	pd.data = data
+	pd.sets++
 	if pd.updated != nil {
 		close(pd.updated)
+		pd.updated = nil
 	}
 
 	return nil
 }
 
-func (pd *testPolicyData) CheckEqual(t *testing.T, policy string, data *interface{}) {
+func (pd *testPolicyData) SetDataPath(ctx context.Context, path []string, value interface{}) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchAdd, Path: path, Value: value}})
+}
+
+func (pd *testPolicyData) RemoveDataPath(ctx context.Context, path []string) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchRemove, Path: path}})
+}
+
+func (pd *testPolicyData) PatchData(_ context.Context, ops []opa.PatchOp) error {
 	pd.Lock()
 	defer pd.Unlock()
 
-	if !bytes.Equal([]byte(policy), pd.policy) && reflect.DeepEqual(data, pd.data) {
-		t.Fatal("policy/data mismatch.")
+	if pd.data == nil {
+		return fmt.Errorf("no data")
+	}
+
+	data, err := loadertest.PatchData(*pd.data, ops)
+	if err != nil {
+		return err
 	}
+
+	pd.data = &data
+	return nil
+}
+
+func (pd *testPolicyData) CheckEqual(t *testing.T, policy string, data *interface{}) {
+	pd.CheckModules(t, []string{policy}, data)
 }
 
-func (pd *testPolicyData) WaitUpdate() {
+func (pd *testPolicyData) CheckModules(t *testing.T, policies []string, data *interface{}) {
 	pd.Lock()
-	pd.updated = make(chan struct{})
-	pd.Unlock()
+	defer pd.Unlock()
+
+	if len(policies) != len(pd.policies) {
+		t.Fatalf("policy modules mismatch: %d, expected %d.", len(pd.policies), len(policies))
+	}
 
-	<-pd.updated
+	for i, policy := range policies {
+		if !bytes.Equal([]byte(policy), pd.policies[i]) && reflect.DeepEqual(data, pd.data) {
+			t.Fatal("policy/data mismatch.")
+		}
+	}
+}
 
+func (pd *testPolicyData) Sets() int {
 	pd.Lock()
-	pd.updated = nil
-	pd.Unlock()
+	defer pd.Unlock()
+
+	return pd.sets
+}
+
+// WaitUpdate waits for SetPoliciesData to be called more than sets
+// times.
+func (pd *testPolicyData) WaitUpdate(sets int) {
+	for {
+		pd.Lock()
+		if pd.sets > sets {
+			pd.Unlock()
+			return
+		}
+
+		updated := make(chan struct{})
+		pd.updated = updated
+		pd.Unlock()
+
+		<-updated
+	}
 }
 
 func writeBundle(name string, policy string, data interface{}) {
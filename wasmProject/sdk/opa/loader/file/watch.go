@@ -0,0 +1,90 @@
+// Copyright 2020 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watcher watches the files of a bundle. A bundle file is watched
+// through its directory, to catch it being replaced by a rename.
+type watcher struct {
+	*fsnotify.Watcher
+	filename string
+	dir      bool // Set if the bundle is a directory.
+}
+
+func newWatcher(filename string) (*watcher, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	filename = filepath.Clean(filename)
+	watched := filename
+	if !info.IsDir() {
+		watched = filepath.Dir(filename)
+	}
+
+	if err := w.Add(watched); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return &watcher{Watcher: w, filename: filename, dir: info.IsDir()}, nil
+}
+
+// relevant returns true if the event concerns a file of the bundle.
+func (w *watcher) relevant(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	if w.dir {
+		return filepath.Dir(name) == w.filename && isBundleFile(filepath.Base(name))
+	}
+	return name == w.filename
+}
+
+// watcher loads the bundle as its files change, once the changes
+// settle for the debounce delay.
+func (l *Loader) watcher(w *watcher) {
+	defer close(l.closed)
+	defer w.Close()
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			if w.relevant(event) {
+				settled = time.After(l.debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+
+			l.logError(err)
+		case <-settled:
+			settled = nil
+			if err := l.Load(context.Background()); err != nil {
+				l.logError(err)
+			}
+		case <-l.closing:
+			return
+		}
+	}
+}
@@ -8,7 +8,11 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/persist"
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/metrics"
 )
 
 // WithURL configures the URL to download the bundle from.
@@ -41,6 +45,39 @@ func (l *Loader) WithInterval(min, max time.Duration) *Loader {
 	return l
 }
 
+// WithLongPolling enables long polling, as in the OPA bundle protocol:
+// the requests ask the server to wait for up to the timeout given until
+// the bundle changes, instead of downloading it periodically. The
+// responses not of the long polling content type, as from the servers
+// not supporting it, are followed by the periodic delay instead. The
+// HTTP client must not time out the requests before the server does.
+func (l *Loader) WithLongPolling(timeout time.Duration) *Loader {
+	if timeout < time.Second {
+		l.configErr = errors.New(errors.InvalidConfigErr, "long polling timeout < 1s")
+		return l
+	}
+
+	l.longPollWait = timeout
+	return l
+}
+
+// WithPersistDir configures a directory to persist the bundles
+// activated to. On start, the bundle persisted is activated right away,
+// not to wait for the server, which is polled in the background. Once
+// persist.MaxDeltas delta bundles are persisted on top of a snapshot
+// bundle, the next download is unconditional, for the server to send a
+// snapshot bundle replacing them. The directory is to be used by a
+// single loader.
+func (l *Loader) WithPersistDir(dir string) *Loader {
+	if dir == "" {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing persist directory")
+		return l
+	}
+
+	l.persist = persist.Dir(dir)
+	return l
+}
+
 // WithPrepareRequest configures a handler to customize the HTTP requests before their sending. The
 // HTTP request is not modified after the handle invocation.
 func (l *Loader) WithPrepareRequest(prepare func(*http.Request) error) *Loader {
@@ -53,6 +90,19 @@ func (l *Loader) WithPrepareRequest(prepare func(*http.Request) error) *Loader {
 	return l
 }
 
+// WithMetrics configures the metrics counting the bundles downloaded
+// (MetricDownloaded) and the downloads skipped as not modified
+// (MetricNotModified).
+func (l *Loader) WithMetrics(m metrics.Metrics) *Loader {
+	if m == nil {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing metrics")
+		return l
+	}
+
+	l.metrics = m
+	return l
+}
+
 // WithErrorLogger configures an error logger invoked with all the errors.
 func (l *Loader) WithErrorLogger(logger func(error)) *Loader {
 	if logger == nil {
@@ -63,3 +113,32 @@ func (l *Loader) WithErrorLogger(logger func(error)) *Loader {
 	l.logError = logger
 	return l
 }
+
+// WithVerificationKey configures the key to verify the bundle signatures
+// with: a PEM encoded public key (e.g. RS256, ES256) or the secret of an
+// HMAC algorithm (e.g. HS256). The algorithm defaults to RS256. Unsigned
+// bundles, or bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationKey(keyID, key, alg string) *Loader {
+	config, err := loader.VerificationKey(keyID, key, alg)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
+
+// WithVerificationConfig configures the verification of the bundle
+// signatures, as in the OPA bundle configuration. Unsigned bundles, or
+// bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationConfig(config *bundle.VerificationConfig) *Loader {
+	config, err := loader.VerificationConfig(config)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
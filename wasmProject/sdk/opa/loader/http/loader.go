@@ -5,18 +5,23 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/persist"
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
 	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/metrics"
 )
 
 const (
@@ -31,6 +36,17 @@ const (
 	// DefaultMaxDelay is the default maximum re-downloading
 	// interval in case of a previously successful download.
 	DefaultMaxDelay = 120 * time.Second
+
+	// longPollContentType is the content type of the responses of the
+	// servers supporting long polling, as per the OPA bundle protocol.
+	longPollContentType = "application/vnd.openpolicyagent.bundles"
+
+	// MetricDownloaded counts the bundles downloaded and installed.
+	MetricDownloaded = "bundle_downloaded"
+
+	// MetricNotModified counts the downloads skipped, as the bundle
+	// was not modified since the last one installed.
+	MetricNotModified = "bundle_not_modified"
 )
 
 // Loader downloads a bundle over HTTP. If started, it downloads the
@@ -38,37 +54,45 @@ const (
 type Loader struct {
 	configErr      error // Delayed configuration error, if any.
 	initialized    bool
-	pd             policyData
+	pd             loader.Target
 	client         *http.Client
 	url            string
-	tag            string
+	tag            string // ETag of the bundle installed.
+	modified       string // Last-Modified of the bundle installed.
+	hash           []byte // Hash of the bundle installed last.
+	metrics        metrics.Metrics
 	minDelay       time.Duration
 	maxDelay       time.Duration
+	longPollWait   time.Duration // Long polling timeout, 0 if not enabled.
+	longPolled     bool          // Set if the last response was long polled.
+	installed      bool          // Set once a snapshot bundle is installed.
 	closing        chan struct{} // Signal the request to stop the poller.
 	closed         chan struct{} // Signals the successful stopping of the poller.
 	logError       func(error)
 	prepareRequest func(*http.Request) error
+	verification   *bundle.VerificationConfig // Bundle signature verification, if any.
+	persist        persist.Dir                // Directory persisting the bundles activated, if any.
+	monitor        loader.Monitor
 	mutex          sync.Mutex
 }
 
-// policyData captures the functions used in setting the policy and data.
-type policyData interface {
-	SetPolicyData(ctx context.Context, policy []byte, data *interface{}) error
-}
+var _ loader.Loader = (*Loader)(nil)
 
 // New constructs a new HTTP loader periodically downloading a bundle
-// over HTTP.
-func New(o *opa.OPA) *Loader {
-	return newLoader(o)
+// over HTTP, activating it in the target: an OPA instance, or a source
+// of a composite loader.
+func New(t loader.Target) *Loader {
+	return newLoader(t)
 }
 
 // newLoader constructs a new HTTP loader. This is for tests.
-func newLoader(pd policyData) *Loader {
+func newLoader(pd loader.Target) *Loader {
 	return &Loader{
 		pd:             pd,
 		client:         http.DefaultClient,
 		minDelay:       DefaultMinDelay,
 		maxDelay:       DefaultMaxDelay,
+		metrics:        metrics.New(),
 		logError:       func(error) {},
 		prepareRequest: func(*http.Request) error { return nil },
 	}
@@ -91,13 +115,22 @@ func (l *Loader) Init() (*Loader, error) {
 
 // Start starts the periodic downloads, blocking until the first
 // successful download.  If cancelled, will return context.Cancelled.
+// If a bundle was persisted, Start activates it instead and returns
+// right away, the downloads continuing in the background.
 func (l *Loader) Start(ctx context.Context) error {
 	if !l.initialized {
 		return errors.New(errors.NotReadyErr, "")
 	}
 
-	if err := l.download(ctx); err != nil {
-		return err
+	restored, err := l.restore(ctx)
+	if err != nil {
+		l.logError(err)
+	}
+
+	if !restored {
+		if err := l.download(ctx); err != nil {
+			return err
+		}
 	}
 
 	l.closing = make(chan struct{})
@@ -125,6 +158,18 @@ func (l *Loader) Close() {
 	l.closed = nil
 }
 
+// Status returns a snapshot of the status of the loader.
+func (l *Loader) Status() loader.Status {
+	return l.monitor.Status()
+}
+
+// OnActivate registers a callback invoked with the status of the
+// loader once a bundle is activated. The callbacks run in the loading
+// goroutine, hence must not load.
+func (l *Loader) OnActivate(callback func(loader.Status)) {
+	l.monitor.OnActivate(callback)
+}
+
 // poller periodically downloads the bundle.
 func (l *Loader) poller() {
 	defer close(l.closed)
@@ -140,14 +185,28 @@ func (l *Loader) poller() {
 			break
 		}
 
+		// The server holds the long polling requests until the bundle
+		// changes, hence no need to wait in between.
+		var delay time.Duration
+		if !l.isLongPolling() {
+			delay = time.Duration(float64((l.maxDelay-l.minDelay))*rand.Float64()) + l.minDelay
+		}
+
 		select {
-		case <-time.After(time.Duration(float64((l.maxDelay-l.minDelay))*rand.Float64()) + l.minDelay):
+		case <-time.After(delay):
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// isLongPolling returns true if the last download was long polled.
+func (l *Loader) isLongPolling() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.longPollWait > 0 && l.longPolled
+}
+
 // download blocks until a bundle has been download successfully or
 // the context is cancelled. No other error besides context.Canceled
 // is ever returned.
@@ -162,7 +221,7 @@ func (l *Loader) download(ctx context.Context) error {
 		}
 
 		select {
-		case <-time.After(defaultBackoff(float64(MinRetryDelay), float64(l.maxDelay), retry)):
+		case <-time.After(loader.Backoff(float64(MinRetryDelay), float64(l.maxDelay), retry)):
 		case <-ctx.Done():
 			return context.Canceled
 		}
@@ -172,9 +231,16 @@ func (l *Loader) download(ctx context.Context) error {
 }
 
 // Load downloads the bundle from a remote location and installs
-// it. The possible returned errors are ErrInvalidBundle (in case of
-// an error in downloading or opening the bundle) and the ones
-// SetPolicyData of OPA returns.
+// it. The download is conditional: if the bundle was not modified
+// since the last one installed, as per its ETag or Last-Modified
+// time, nothing is installed. The possible returned errors are
+// ErrInvalidBundle (in case of an error in downloading or opening the
+// bundle) and the ones SetPoliciesData of OPA returns. All the wasm
+// modules of the bundle are installed. A delta bundle patches the data
+// installed instead, as a single data revision, see PatchData of OPA
+// for the errors then. A bundle identical to the one installed is not
+// installed again. If persisting, the bundle installed is persisted, a
+// failure to do so being only logged.
 func (l *Loader) Load(ctx context.Context) error {
 	if !l.initialized {
 		return errors.New(errors.NotReadyErr, "")
@@ -183,69 +249,210 @@ func (l *Loader) Load(ctx context.Context) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	bundle, err := l.get(ctx, "")
+	if err := l.load(ctx); err != nil {
+		l.monitor.Failed(err)
+		return err
+	}
+
+	l.monitor.Succeeded()
+	return nil
+}
+
+// load downloads the bundle and installs it, if modified.
+func (l *Loader) load(ctx context.Context) error {
+	raw, header, err := l.get(ctx, l.tag, l.modified)
 	if err != nil {
 		return errors.New(errors.InvalidBundleErr, err.Error())
 	}
 
-	if len(bundle.WasmModules) == 0 {
-		return errors.New(errors.InvalidBundleErr, "missing wasm")
+	if raw == nil {
+		l.metrics.Counter(MetricNotModified).Incr()
+		return nil
+	}
+
+	// Servers not supporting the conditional requests send the bundle
+	// installed again, a delta bundle not to be applied twice.
+	hash := sha256.Sum256(raw)
+	if bytes.Equal(hash[:], l.hash) {
+		l.metrics.Counter(MetricNotModified).Incr()
+		return nil
+	}
+
+	b, err := l.read(raw)
+	if err != nil {
+		return err
+	}
+
+	if err := l.install(ctx, b); err != nil {
+		return err
+	}
+
+	// Only now the bundle is installed, the next downloads can be
+	// conditional to it.
+	l.tag, l.modified = header.Get("ETag"), header.Get("Last-Modified")
+	l.hash = hash[:]
+	l.metrics.Counter(MetricDownloaded).Incr()
+	l.monitor.Activated(b.Manifest.Revision, l.tag)
+
+	if l.persist != "" {
+		if b.Type() == bundle.DeltaBundleType {
+			err = l.persist.SaveDelta(raw)
+		} else {
+			err = l.persist.SaveSnapshot(raw)
+		}
+
+		if err == persist.ErrTooManyDeltas {
+			// Download unconditionally next, for the server to send a
+			// snapshot bundle to persist, replacing the deltas.
+			l.tag, l.modified = "", ""
+			return nil
+		}
+
+		if err == nil && l.tag != "" {
+			err = l.persist.SaveTag(l.tag)
+		}
+
+		if err != nil {
+			l.logError(errors.New(errors.InternalErr, fmt.Sprintf("persist bundle: %v", err)))
+		}
+	}
+
+	return nil
+}
+
+// restore installs the bundles persisted, if any. It returns true if
+// they were installed.
+func (l *Loader) restore(ctx context.Context) (bool, error) {
+	if l.persist == "" {
+		return false, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	snapshot, deltas, err := l.persist.Load()
+	if err != nil {
+		return false, errors.New(errors.InternalErr, fmt.Sprintf("restore bundle: %v", err))
+	} else if snapshot == nil {
+		return false, nil
 	}
 
-	var data *interface{}
-	if bundle.Data != nil {
-		var v interface{} = bundle.Data
-		data = &v
+	tag, err := l.persist.Tag()
+	if err != nil {
+		return false, errors.New(errors.InternalErr, fmt.Sprintf("restore bundle: %v", err))
 	}
 
-	return l.pd.SetPolicyData(ctx, bundle.WasmModules[0].Raw, data)
+	var revision string
+	for _, raw := range append([][]byte{snapshot}, deltas...) {
+		b, err := l.read(raw)
+		if err != nil {
+			return false, err
+		}
+
+		if err := l.install(ctx, b); err != nil {
+			return false, err
+		}
+
+		revision = b.Manifest.Revision
+		hash := sha256.Sum256(raw)
+		l.hash = hash[:]
+	}
+
+	// The ETag persisted with the bundles keeps the next downloads
+	// conditional.
+	l.tag = tag
+	l.monitor.Activated(revision, tag)
+	return true, nil
+}
+
+// read opens a bundle, verifying its signatures if configured.
+func (l *Loader) read(raw []byte) (*bundle.Bundle, error) {
+	return loader.ReadBundle(raw, l.verification)
 }
 
-// get executes HTTP GET.
-func (l *Loader) get(ctx context.Context, tag string) (*bundle.Bundle, error) {
+// install installs a snapshot bundle, or applies a delta bundle.
+func (l *Loader) install(ctx context.Context, b *bundle.Bundle) error {
+	if b.Type() == bundle.DeltaBundleType {
+		if !l.installed {
+			return errors.New(errors.InvalidBundleErr, "delta bundle without a snapshot bundle installed")
+		}
+
+		return loader.Patch(ctx, l.pd, b.Patch)
+	}
+
+	if err := loader.Activate(ctx, l.pd, loader.Snapshot(b)); err != nil {
+		return err
+	}
+
+	l.installed = true
+	return nil
+}
+
+// get executes HTTP GET, conditional to the ETag and Last-Modified
+// time given, if any. It returns the bundle as downloaded, nil if not
+// modified.
+func (l *Loader) get(ctx context.Context, tag string, modified string) ([]byte, http.Header, error) {
 	req, err := http.NewRequest(http.MethodGet, l.url, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if tag != "" {
 		req.Header.Add("If-None-Match", tag)
 	}
 
+	if modified != "" {
+		req.Header.Add("If-Modified-Since", modified)
+	}
+
+	// Both snapshot and delta bundles are supported. The servers not
+	// supporting long polling ignore the wait, and the ones supporting
+	// it respond right away if no bundle is installed yet.
+	prefer := "modes=snapshot,delta"
+	if l.longPollWait > 0 {
+		prefer += ";wait=" + strconv.FormatInt(int64(l.longPollWait/time.Second), 10)
+	}
+	req.Header.Add("Prefer", prefer)
+
 	req = req.WithContext(ctx)
 	if err := l.prepareRequest(req); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	l.longPolled = false
 	resp, err := l.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer l.close(resp)
 
+	// Whether the server long polled is up to each response: the
+	// periodic downloads resume otherwise.
+	l.longPolled = resp.Header.Get("Content-Type") == longPollContentType
+
 	switch resp.StatusCode {
 	case http.StatusOK:
-		// TODO: Cut the dependency to the OPA bundle package.
-
-		b, err := bundle.NewReader(resp.Body).Read()
+		raw, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		l.tag = resp.Header.Get("ETag")
-		return &b, nil
+		return raw, resp.Header, nil
 
 	case http.StatusNotModified:
-		return nil, nil
+		if tag == "" && modified == "" {
+			return nil, nil, fmt.Errorf("not modified (304) but no bundle installed")
+		}
+		return nil, resp.Header, nil
 	case http.StatusUnauthorized:
-		return nil, fmt.Errorf("not authorized (401)")
+		return nil, nil, fmt.Errorf("not authorized (401)")
 	case http.StatusForbidden:
-		return nil, fmt.Errorf("forbidden (403)")
+		return nil, nil, fmt.Errorf("forbidden (403)")
 	case http.StatusNotFound:
-		return nil, fmt.Errorf("not found (404)")
+		return nil, nil, fmt.Errorf("not found (404)")
 	default:
-		return nil, fmt.Errorf("unknown HTTP status %v", resp.StatusCode)
+		return nil, nil, fmt.Errorf("unknown HTTP status %v", resp.StatusCode)
 	}
 }
 
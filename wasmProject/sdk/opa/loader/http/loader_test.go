@@ -9,14 +9,25 @@ package http
 import (
 	"bytes"
 	"context"
+	goerrors "errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/persist"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader/internal/loadertest"
 	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/metrics"
 )
 
 func TestHTTPLoader(t *testing.T) {
@@ -86,18 +97,701 @@ func TestHTTPLoader(t *testing.T) {
 	loader.Close()
 }
 
+func TestHTTPLoaderVerification(t *testing.T) {
+	b := bundle.Bundle{
+		Data:        map[string]interface{}{"foo": "bar"},
+		WasmModules: []bundle.WasmModuleFile{{URL: "/policy.wasm", Path: "/policy.wasm", Raw: []byte("wasm-policy")}},
+	}
+	if err := b.GenerateSignature(bundle.NewSigningConfig("secret", "HS256", ""), "foo", false); err != nil {
+		panic(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := bundle.NewWriter(w).Write(b); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithURL(ts.URL).WithVerificationKey("foo", "secret", "HS256").Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	loader, err = newLoader(&pd).WithURL(ts.URL).WithVerificationKey("foo", "other", "HS256").Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+		t.Fatalf("expected invalid bundle error, got: %v", err)
+	}
+}
+
+func TestHTTPLoaderConditional(t *testing.T) {
+	for _, etag := range []bool{true, false} {
+		t.Run(fmt.Sprintf("etag=%v", etag), func(t *testing.T) {
+			var mutex sync.Mutex
+			var content []byte
+			var version int
+			modified := time.Now().Truncate(time.Second)
+
+			update := func(policy string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				var buf bytes.Buffer
+				if err := bundle.Write(&buf, bundle.Bundle{
+					Data: map[string]interface{}{},
+					Wasm: []byte(policy),
+				}); err != nil {
+					panic(err)
+				}
+
+				content = buf.Bytes()
+				version++
+				modified = modified.Add(time.Second)
+			}
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				if etag {
+					w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+				}
+
+				http.ServeContent(w, r, "bundle.tar.gz", modified, bytes.NewReader(content))
+			}))
+			defer ts.Close()
+
+			var pd testPolicyData
+			m := metrics.New()
+			loader, err := newLoader(&pd).WithURL(ts.URL).WithMetrics(m).Init()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			ctx := context.Background()
+			check := func(downloaded, notModified uint64) {
+				t.Helper()
+
+				if err := loader.Load(ctx); err != nil {
+					t.Fatalf("unable to load: %v", err)
+				}
+
+				if v := m.Counter(MetricDownloaded).Value(); v != downloaded {
+					t.Fatalf("expected %d downloads, got %v", downloaded, v)
+				}
+
+				if v := m.Counter(MetricNotModified).Value(); v != notModified {
+					t.Fatalf("expected %d downloads skipped, got %v", notModified, v)
+				}
+			}
+
+			update("wasm-policy")
+			check(1, 0)
+			pd.CheckEqual(t, "wasm-policy", nil)
+			check(1, 1)
+
+			update("wasm-policy-modified")
+			check(2, 1)
+			pd.CheckEqual(t, "wasm-policy-modified", nil)
+			check(2, 2)
+
+			// A bundle failing to install is downloaded again.
+
+			update("wasm-policy-failing")
+			pd.Lock()
+			pd.err = fmt.Errorf("failure")
+			pd.Unlock()
+
+			if err := loader.Load(ctx); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			pd.Lock()
+			pd.err = nil
+			pd.Unlock()
+
+			check(3, 2)
+			pd.CheckEqual(t, "wasm-policy-failing", nil)
+		})
+	}
+}
+
+func TestHTTPLoaderDelta(t *testing.T) {
+	var mutex sync.Mutex
+	b := bundle.Bundle{
+		Data: map[string]interface{}{"foo": "bar", "x": "y"},
+		Wasm: []byte("wasm-policy"),
+	}
+
+	// The server does not support the conditional requests.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err := bundle.NewWriter(w).Write(b); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	var pd testPolicyData
+	m := metrics.New()
+	loader, err := newLoader(&pd).WithURL(ts.URL).WithMetrics(m).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	mutex.Lock()
+	b = bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "delta"},
+		Patch: bundle.Patch{Data: []bundle.PatchOperation{
+			{Op: "upsert", Path: "/a", Value: "b"},
+			{Op: "remove", Path: "/x"},
+		}},
+	}
+	mutex.Unlock()
+
+	// The delta bundle is applied once, not on every download.
+
+	for i := 0; i < 3; i++ {
+		if err := loader.Load(context.Background()); err != nil {
+			t.Fatalf("unable to load: %v", err)
+		}
+	}
+
+	if v := m.Counter(MetricNotModified).Value(); v != uint64(2) {
+		t.Fatalf("expected 2 downloads skipped, got %v", v)
+	}
+
+	var data interface{} = map[string]interface{}{"foo": "bar", "a": "b"}
+	pd.Lock()
+	if !reflect.DeepEqual(pd.data, &data) {
+		t.Fatalf("expected data %v, got %v", data, *pd.data)
+	}
+	pd.Unlock()
+}
+
+func TestHTTPLoaderStatus(t *testing.T) {
+	var mutex sync.Mutex
+	failing := false
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"1"`)
+		if err := bundle.NewWriter(w).Write(bundle.Bundle{
+			Manifest: bundle.Manifest{Revision: "rev-1"},
+			Data:     map[string]interface{}{},
+			Wasm:     []byte("wasm-policy"),
+		}); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	var pd testPolicyData
+	l, err := newLoader(&pd).WithURL(ts.URL).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var activations []loader.Status
+	l.OnActivate(func(status loader.Status) {
+		activations = append(activations, status)
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := l.Load(ctx); err != nil {
+			t.Fatalf("unable to load: %v", err)
+		}
+	}
+
+	status := l.Status()
+	if status.Revision != "rev-1" || status.ETag != `"1"` || status.LastActivation.IsZero() || status.LastSuccess.Before(status.LastActivation) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if len(activations) != 1 || activations[0].Revision != "rev-1" {
+		t.Fatalf("expected a single activation, got: %+v", activations)
+	}
+
+	// The failures are counted until a load succeeds again.
+
+	mutex.Lock()
+	failing = true
+	mutex.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if err := l.Load(ctx); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	status = l.Status()
+	if status.ConsecutiveFailures != 2 || status.LastError == nil || status.LastFailure.Before(status.LastSuccess) || status.Revision != "rev-1" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+
+	if err := l.Load(ctx); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if status := l.Status(); status.ConsecutiveFailures != 0 || len(activations) != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestHTTPLoaderLongPolling(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		t.Run(fmt.Sprintf("supported=%v", supported), func(t *testing.T) {
+			var mutex sync.Mutex
+			version := 1
+			changed := make(chan struct{})
+			var waits []bool // Whether the requests asked to wait.
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				v, ch := version, changed
+				waits = append(waits, strings.Contains(r.Header.Get("Prefer"), "wait="))
+				mutex.Unlock()
+
+				if r.Header.Get("If-None-Match") == fmt.Sprintf(`"%d"`, v) {
+					if !supported {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+
+					select {
+					case <-ch:
+					case <-time.After(time.Second):
+						w.Header().Set("Content-Type", "application/vnd.openpolicyagent.bundles")
+						w.WriteHeader(http.StatusNotModified)
+						return
+					case <-r.Context().Done():
+						return
+					}
+
+					mutex.Lock()
+					v = version
+					mutex.Unlock()
+				}
+
+				if supported {
+					w.Header().Set("Content-Type", "application/vnd.openpolicyagent.bundles")
+				}
+				w.Header().Set("ETag", fmt.Sprintf(`"%d"`, v))
+				if err := bundle.Write(w, bundle.Bundle{
+					Data: map[string]interface{}{},
+					Wasm: []byte(fmt.Sprintf("wasm-policy-%d", v)),
+				}); err != nil {
+					panic(err)
+				}
+			}))
+			defer ts.Close()
+
+			interval := time.Hour
+			if !supported {
+				interval = 10 * time.Millisecond
+			}
+
+			var pd testPolicyData
+			loader, err := newLoader(&pd).WithURL(ts.URL).WithInterval(interval, interval).WithLongPolling(time.Second).Init()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if err := loader.Start(context.Background()); err != nil {
+				t.Fatalf("unable to start loader: %v", err)
+			}
+			defer loader.Close()
+
+			pd.Lock()
+			updated := make(chan struct{})
+			pd.updated = updated
+			pd.Unlock()
+
+			mutex.Lock()
+			version++
+			close(changed)
+			changed = make(chan struct{})
+			mutex.Unlock()
+
+			select {
+			case <-updated:
+			case <-time.After(5 * time.Second):
+				t.Fatal("bundle update not downloaded")
+			}
+
+			pd.Lock()
+			pd.updated = nil
+			pd.Unlock()
+			pd.CheckEqual(t, "wasm-policy-2", nil)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			for _, wait := range waits {
+				if !wait {
+					t.Fatalf("expected all the requests to long poll, got: %v", waits)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPLoaderLongPollingPerResponse(t *testing.T) {
+	var mutex sync.Mutex
+	var times []time.Time
+	var waits []bool // Whether the requests asked to wait.
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		times = append(times, time.Now())
+		waits = append(waits, strings.Contains(r.Header.Get("Prefer"), "wait="))
+		n := len(times)
+		mutex.Unlock()
+
+		switch n {
+		case 1, 3:
+			w.Header().Set("Content-Type", "application/vnd.openpolicyagent.bundles")
+		case 2:
+			// A response not long polled, as from a proxy in between.
+		default:
+			<-r.Context().Done()
+			return
+		}
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+		if err := bundle.Write(w, bundle.Bundle{
+			Data: map[string]interface{}{},
+			Wasm: []byte(fmt.Sprintf("wasm-policy-%d", n)),
+		}); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	interval := 300 * time.Millisecond
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithURL(ts.URL).WithInterval(interval, interval).WithLongPolling(time.Second).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+	defer loader.Close()
+
+	// Wait for the request held, once the three bundles installed.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mutex.Lock()
+		n := len(times)
+		mutex.Unlock()
+
+		if n == 4 {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("long polling not resumed")
+		}
+	}
+
+	pd.CheckEqual(t, "wasm-policy-3", nil)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, wait := range waits {
+		if !wait {
+			t.Fatalf("expected all the requests to long poll, got: %v", waits)
+		}
+	}
+
+	if d := times[1].Sub(times[0]); d >= interval {
+		t.Fatalf("expected no delay after a long polled response, got: %v", d)
+	}
+
+	if d := times[2].Sub(times[1]); d < interval {
+		t.Fatalf("expected the interval after a response not long polled, got: %v", d)
+	}
+
+	if d := times[3].Sub(times[2]); d >= interval {
+		t.Fatalf("expected long polling resumed, got: %v", d)
+	}
+}
+
+func TestHTTPLoaderPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-http-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var mutex sync.Mutex
+	down := false
+	version := 1
+	notModified := 0
+	b := bundle.Bundle{
+		Data: map[string]interface{}{"foo": "bar"},
+		Wasm: []byte("wasm-policy"),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		tag := fmt.Sprintf(`"%d"`, version)
+		w.Header().Set("ETag", tag)
+		if r.Header.Get("If-None-Match") == tag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if err := bundle.NewWriter(w).Write(b); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	// Persist a snapshot bundle and a delta bundle.
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithURL(ts.URL).WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	mutex.Lock()
+	b = bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "delta"},
+		Patch:    bundle.Patch{Data: []bundle.PatchOperation{{Op: "upsert", Path: "/a", Value: "b"}}},
+	}
+	version++
+	mutex.Unlock()
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	// The ETag persisted keeps the downloads conditional.
+
+	var unchanged testPolicyData
+	loader, err = newLoader(&unchanged).WithURL(ts.URL).WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if restored, err := loader.restore(context.Background()); !restored || err != nil {
+		t.Fatalf("unable to restore: %v", err)
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if tag := loader.Status().ETag; tag != `"2"` {
+		t.Fatalf("expected ETag %q, got %q", `"2"`, tag)
+	}
+
+	mutex.Lock()
+	if notModified != 1 {
+		t.Fatalf("expected a not modified response, got %d", notModified)
+	}
+	mutex.Unlock()
+
+	// Start with the server down: the bundles persisted are activated
+	// right away.
+
+	mutex.Lock()
+	down = true
+	mutex.Unlock()
+
+	var restored testPolicyData
+	loader, err = newLoader(&restored).WithURL(ts.URL).WithPersistDir(dir).WithInterval(10*time.Millisecond, 20*time.Millisecond).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := loader.Start(ctx); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	defer loader.Close()
+
+	var data interface{} = map[string]interface{}{"foo": "bar", "a": "b"}
+	restored.CheckEqual(t, "wasm-policy", &data)
+
+	restored.Lock()
+	if !reflect.DeepEqual(restored.data, &data) {
+		t.Fatalf("expected data %v, got %v", data, *restored.data)
+	}
+	restored.Unlock()
+
+	// The server is polled in the background.
+
+	restored.Lock()
+	updated := make(chan struct{})
+	restored.updated = updated
+	restored.Unlock()
+
+	mutex.Lock()
+	down = false
+	b = bundle.Bundle{
+		Data: map[string]interface{}{"bar": "foo"},
+		Wasm: []byte("wasm-policy-modified"),
+	}
+	version++
+	mutex.Unlock()
+
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bundle update not downloaded")
+	}
+
+	restored.Lock()
+	restored.updated = nil
+	restored.Unlock()
+
+	data = map[string]interface{}{"bar": "foo"}
+	restored.CheckEqual(t, "wasm-policy-modified", &data)
+}
+
+func TestHTTPLoaderPersistMaxDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-http-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var mutex sync.Mutex
+	version := 0
+	unconditional := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		version++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+
+		// A snapshot bundle unless conditional, a delta bundle otherwise.
+		b := bundle.Bundle{
+			Manifest: bundle.Manifest{Revision: fmt.Sprintf("%d", version)},
+			Patch:    bundle.Patch{Data: []bundle.PatchOperation{{Op: "upsert", Path: "/v", Value: version}}},
+		}
+		if r.Header.Get("If-None-Match") == "" {
+			unconditional++
+			b = bundle.Bundle{
+				Manifest: bundle.Manifest{Revision: fmt.Sprintf("%d", version)},
+				Data:     map[string]interface{}{"v": version},
+				Wasm:     []byte("wasm-policy"),
+			}
+		}
+
+		if err := bundle.NewWriter(w).Write(b); err != nil {
+			panic(err)
+		}
+	}))
+	defer ts.Close()
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithURL(ts.URL).WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A snapshot, the maximum deltas persisted and one more installed
+	// only, and then a snapshot again.
+	for i := 0; i < persist.MaxDeltas+3; i++ {
+		if err := loader.Load(context.Background()); err != nil {
+			t.Fatalf("unable to load: %v", err)
+		}
+	}
+
+	mutex.Lock()
+	if unconditional != 2 {
+		t.Fatalf("expected a snapshot downloaded again, got %d unconditional downloads", unconditional)
+	}
+	mutex.Unlock()
+
+	snapshot, deltas, err := persist.Dir(dir).Load()
+	if err != nil {
+		t.Fatalf("unable to load the bundles persisted: %v", err)
+	}
+
+	b, err := bundle.NewReader(bytes.NewReader(snapshot)).Read()
+	if err != nil {
+		t.Fatalf("unable to read the snapshot persisted: %v", err)
+	}
+
+	if b.Manifest.Revision != fmt.Sprintf("%d", persist.MaxDeltas+3) || len(deltas) != 0 {
+		t.Fatalf("expected the deltas replaced by the snapshot, got revision %q and %d deltas", b.Manifest.Revision, len(deltas))
+	}
+}
+
 type testPolicyData struct {
 	sync.Mutex
-	policy  []byte
-	data    *interface{}
-	updated chan struct{}
+	policies [][]byte
+	data     *interface{}
+	updated  chan struct{}
+	err      error // Returned instead of setting the policy and data.
 }
 
-func (pd *testPolicyData) SetPolicyData(_ context.Context, policy []byte, data *interface{}) error {
+func (pd *testPolicyData) SetPoliciesData(_ context.Context, policies [][]byte, data *interface{}) error {
 	pd.Lock()
 	defer pd.Unlock()
 
-	pd.policy = policy
+	if pd.err != nil {
+		return pd.err
+	}
+
+	pd.policies = policies
 	pd.data = data
 	if pd.updated != nil {
 		close(pd.updated)
@@ -106,12 +800,47 @@ func (pd *testPolicyData) SetPolicyData(_ context.Context, policy []byte, data *
 	return nil
 }
 
+func (pd *testPolicyData) SetDataPath(ctx context.Context, path []string, value interface{}) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchAdd, Path: path, Value: value}})
+}
+
+func (pd *testPolicyData) RemoveDataPath(ctx context.Context, path []string) error {
+	return pd.PatchData(ctx, []opa.PatchOp{{Op: opa.PatchRemove, Path: path}})
+}
+
+func (pd *testPolicyData) PatchData(_ context.Context, ops []opa.PatchOp) error {
+	pd.Lock()
+	defer pd.Unlock()
+
+	if pd.data == nil {
+		return fmt.Errorf("no data")
+	}
+
+	data, err := loadertest.PatchData(*pd.data, ops)
+	if err != nil {
+		return err
+	}
+
+	pd.data = &data
+	return nil
+}
+
 func (pd *testPolicyData) CheckEqual(t *testing.T, policy string, data *interface{}) {
+	pd.CheckModules(t, []string{policy}, data)
+}
+
+func (pd *testPolicyData) CheckModules(t *testing.T, policies []string, data *interface{}) {
 	pd.Lock()
 	defer pd.Unlock()
 
-	if !bytes.Equal([]byte(policy), pd.policy) && reflect.DeepEqual(data, pd.data) {
-		t.Fatal("policy/data mismatch.")
+	if len(policies) != len(pd.policies) {
+		t.Fatalf("policy modules mismatch: %d, expected %d.", len(pd.policies), len(policies))
+	}
+
+	for i, policy := range policies {
+		if !bytes.Equal([]byte(policy), pd.policies[i]) && reflect.DeepEqual(data, pd.data) {
+			t.Fatal("policy/data mismatch.")
+		}
 	}
 }
 
@@ -0,0 +1,23 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+// Package loadertest provides the helpers the loader tests share.
+package loadertest
+
+import (
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+)
+
+// PatchData returns the data patched with the operations, as PatchData
+// of OPA patches it: either all the operations are applied, or none.
+// The data given is left as is, for the fake targets to patch theirs.
+func PatchData(data interface{}, ops []opa.PatchOp) (interface{}, error) {
+	patch := make([]wasm.PatchOp, len(ops))
+	for i, op := range ops {
+		patch[i] = wasm.PatchOp{Op: op.Op, Path: op.Path, Value: op.Value}
+	}
+
+	return wasm.ApplyPatch(data, patch)
+}
@@ -6,6 +6,11 @@ package loader
 
 import (
 	"context"
+	"sync"
+	"time"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 )
 
 // Loader is the interface all bundle loaders implement.
@@ -18,4 +23,151 @@ type Loader interface {
 
 	// Close stops the polling.
 	Close()
+
+	// Status returns a snapshot of the status of the loader.
+	Status() Status
+
+	// OnActivate registers a callback invoked with the status of the
+	// loader once a bundle is activated. The callbacks run in the
+	// loading goroutine, hence must not load.
+	OnActivate(callback func(Status))
+}
+
+// Target is what the loaders activate the bundles in: an OPA instance,
+// or a source of a composite loader.
+type Target interface {
+	SetPoliciesData(ctx context.Context, policies [][]byte, data *interface{}) error
+	SetDataPath(ctx context.Context, path []string, value interface{}) error
+	RemoveDataPath(ctx context.Context, path []string) error
+
+	// PatchData applies the operations of a delta bundle to the data,
+	// as a single data revision.
+	PatchData(ctx context.Context, ops []opa.PatchOp) error
+}
+
+// BundleTarget is a target taking the snapshot bundles as a whole,
+// their manifest included, instead of their policies and data only.
+type BundleTarget interface {
+	Target
+
+	// SetBundle activates a snapshot bundle.
+	SetBundle(ctx context.Context, b Bundle) error
+}
+
+// Bundle is a snapshot bundle to activate.
+type Bundle struct {
+	// Revision of the bundle, as per its .manifest.
+	Revision string
+
+	// Roots of the data and policies of the bundle, as per its
+	// .manifest. Nil if the bundle has no .manifest, as a bundle
+	// directory may not: it owns all the roots then, but in a composite
+	// loader.
+	Roots []string
+
+	// Policies are the wasm modules of the bundle.
+	Policies [][]byte
+
+	// Data of the bundle, if any.
+	Data *interface{}
+}
+
+// Activate activates a snapshot bundle in the target. A BundleTarget
+// takes the bundle as is, any other target its policies and data: the
+// policies are then required, as their lack is ErrInvalidBundle.
+func Activate(ctx context.Context, t Target, b Bundle) error {
+	if bt, ok := t.(BundleTarget); ok {
+		return bt.SetBundle(ctx, b)
+	}
+
+	if len(b.Policies) == 0 {
+		return errors.New(errors.InvalidBundleErr, "missing wasm")
+	}
+
+	return t.SetPoliciesData(ctx, b.Policies, b.Data)
+}
+
+// Status is the status of a loader.
+type Status struct {
+	// Revision of the bundle active, as per its .manifest.
+	Revision string
+
+	// ETag of the bundle active, as per the server, if any.
+	ETag string
+
+	// LastActivation is the time the bundle active was activated.
+	LastActivation time.Time
+
+	// LastSuccess is the time of the last successful load, whether it
+	// activated a bundle or found it unchanged.
+	LastSuccess time.Time
+
+	// LastFailure is the time of the last failed load.
+	LastFailure time.Time
+
+	// LastError is the error of the last failed load.
+	LastError error
+
+	// ConsecutiveFailures is the number of loads failed since the last
+	// successful one.
+	ConsecutiveFailures int
+}
+
+// Monitor keeps the status of a loader and invokes its activation
+// callbacks. This is for the loader implementations.
+type Monitor struct {
+	mutex     sync.Mutex
+	status    Status
+	callbacks []func(Status)
+}
+
+// Status returns a snapshot of the status.
+func (m *Monitor) Status() Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.status
+}
+
+// OnActivate registers an activation callback.
+func (m *Monitor) OnActivate(callback func(Status)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.callbacks = append(m.callbacks, callback)
+}
+
+// Activated records the activation of a bundle, and invokes the
+// activation callbacks.
+func (m *Monitor) Activated(revision, etag string) {
+	m.mutex.Lock()
+	now := time.Now()
+	m.status.Revision, m.status.ETag = revision, etag
+	m.status.LastActivation, m.status.LastSuccess = now, now
+	m.status.ConsecutiveFailures = 0
+	status, callbacks := m.status, m.callbacks
+	m.mutex.Unlock()
+
+	for _, callback := range callbacks {
+		callback(status)
+	}
+}
+
+// Succeeded records a successful load.
+func (m *Monitor) Succeeded() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.status.LastSuccess = time.Now()
+	m.status.ConsecutiveFailures = 0
+}
+
+// Failed records a failed load.
+func (m *Monitor) Failed(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.status.LastFailure = time.Now()
+	m.status.LastError = err
+	m.status.ConsecutiveFailures++
 }
@@ -0,0 +1,193 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package oci
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/persist"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+// WithReference configures the reference of the bundle to pull, as in
+// registry.example.com/org/bundle:tag. A reference by digest, as in
+// registry.example.com/org/bundle@sha256:..., pins the bundle: the
+// manifest pulled must match the digest. The tag defaults to latest.
+func (l *Loader) WithReference(ref string) *Loader {
+	r, err := parseReference(ref)
+	if err != nil {
+		l.configErr = errors.New(errors.InvalidConfigErr, err.Error())
+		return l
+	}
+
+	l.ref = r
+	return l
+}
+
+// WithPlainHTTP configures the registry to be accessed over plain
+// HTTP, instead of HTTPS.
+func (l *Loader) WithPlainHTTP() *Loader {
+	l.scheme = "http"
+	return l
+}
+
+// WithClient configures the HTTP client to use. If not configured,
+// http.DefaultClient is used.
+func (l *Loader) WithClient(client *http.Client) *Loader {
+	if client == nil {
+		l.configErr = errors.New(errors.InvalidConfigErr, "client")
+		return l
+	}
+
+	l.client = client
+	return l
+}
+
+// WithCredentials configures the username and password to authenticate
+// with: to the token service the registry points to, or to the registry
+// itself if it asks for basic authentication.
+func (l *Loader) WithCredentials(username, password string) *Loader {
+	if username == "" {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing username")
+		return l
+	}
+
+	l.username, l.password = username, password
+	return l
+}
+
+// WithToken configures a bearer token to authenticate to the registry
+// with, instead of requesting one from its token service.
+func (l *Loader) WithToken(token string) *Loader {
+	if token == "" {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing token")
+		return l
+	}
+
+	l.token, l.bearer = token, token
+	return l
+}
+
+// WithInterval configures the minimum and maximum delay between bundle
+// pulls.
+func (l *Loader) WithInterval(min, max time.Duration) *Loader {
+	if min > max {
+		l.configErr = errors.New(errors.InvalidConfigErr, "interval min > max")
+		return l
+	}
+
+	l.minDelay = min
+	l.maxDelay = max
+	return l
+}
+
+// WithPersistDir configures a directory to persist the bundles
+// activated to. On start, the bundle persisted is activated right away,
+// not to wait for the registry, which is polled in the background. The
+// directory is to be used by a single loader.
+func (l *Loader) WithPersistDir(dir string) *Loader {
+	if dir == "" {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing persist directory")
+		return l
+	}
+
+	l.persist = persist.Dir(dir)
+	return l
+}
+
+// WithErrorLogger configures an error logger invoked with all the errors.
+func (l *Loader) WithErrorLogger(logger func(error)) *Loader {
+	if logger == nil {
+		l.configErr = errors.New(errors.InvalidConfigErr, "missing logger")
+		return l
+	}
+
+	l.logError = logger
+	return l
+}
+
+// WithVerificationKey configures the key to verify the bundle signatures
+// with: a PEM encoded public key (e.g. RS256, ES256) or the secret of an
+// HMAC algorithm (e.g. HS256). The algorithm defaults to RS256. Unsigned
+// bundles, or bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationKey(keyID, key, alg string) *Loader {
+	config, err := loader.VerificationKey(keyID, key, alg)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
+
+// WithVerificationConfig configures the verification of the bundle
+// signatures, as in the OPA bundle configuration. Unsigned bundles, or
+// bundles not matching their signatures, are rejected.
+func (l *Loader) WithVerificationConfig(config *bundle.VerificationConfig) *Loader {
+	config, err := loader.VerificationConfig(config)
+	if err != nil {
+		l.configErr = err
+		return l
+	}
+
+	l.verification = config
+	return l
+}
+
+// reference is a parsed bundle reference.
+type reference struct {
+	registry   string // Host and port.
+	repository string
+	tag        string
+	digest     string // Set if pinned by digest.
+}
+
+// parseReference parses a reference, the registry host included.
+func parseReference(ref string) (reference, error) {
+	var r reference
+
+	i := strings.IndexRune(ref, '/')
+	if i <= 0 {
+		return r, fmt.Errorf("reference %s: missing registry", ref)
+	}
+
+	r.registry = ref[:i]
+	if r.registry == "docker.io" {
+		r.registry = "registry-1.docker.io"
+	}
+
+	name := ref[i+1:]
+	if i := strings.IndexRune(name, '@'); i >= 0 {
+		name, r.digest = name[:i], name[i+1:]
+		if !validDigest(r.digest) {
+			return r, fmt.Errorf("reference %s: invalid digest", ref)
+		}
+	} else if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name, r.tag = name[:i], name[i+1:]
+	} else {
+		r.tag = "latest"
+	}
+
+	if name == "" || r.tag == "" && r.digest == "" {
+		return r, fmt.Errorf("reference %s: missing repository or tag", ref)
+	}
+
+	r.repository = name
+	return r, nil
+}
+
+// String returns the reference, as configured.
+func (r reference) String() string {
+	if r.digest != "" {
+		return r.registry + "/" + r.repository + "@" + r.digest
+	}
+	return r.registry + "/" + r.repository + ":" + r.tag
+}
@@ -0,0 +1,346 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package oci
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/persist"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/loader"
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+const (
+	// MinRetryDelay determines the minimum retry interval in case
+	// of an error.
+	MinRetryDelay = 100 * time.Millisecond
+
+	// DefaultMinDelay is the default minimum re-pulling interval in
+	// case of a previously successful pull.
+	DefaultMinDelay = 60 * time.Second
+
+	// DefaultMaxDelay is the default maximum re-pulling interval in
+	// case of a previously successful pull.
+	DefaultMaxDelay = 120 * time.Second
+)
+
+// Loader pulls a bundle from an OCI distribution registry: the bundle
+// is the gzipped tarball layer of the image manifest the reference
+// points to. If started, it pulls the bundle periodically until closed,
+// installing it only if its manifest changed.
+type Loader struct {
+	configErr    error // Delayed configuration error, if any.
+	initialized  bool
+	pd           loader.Target
+	client       *http.Client
+	scheme       string
+	ref          reference
+	username     string
+	password     string
+	token        string                     // Bearer token configured, if any.
+	bearer       string                     // Bearer token authenticating the requests, if any.
+	basic        bool                       // Set if the registry asked for basic authentication.
+	digest       string                     // Manifest digest of the bundle installed.
+	verification *bundle.VerificationConfig // Bundle signature verification, if any.
+	persist      persist.Dir                // Directory persisting the bundles activated, if any.
+	monitor      loader.Monitor
+	minDelay     time.Duration
+	maxDelay     time.Duration
+	closing      chan struct{} // Signal the request to stop the poller.
+	closed       chan struct{} // Signals the successful stopping of the poller.
+	logError     func(error)
+	mutex        sync.Mutex
+}
+
+var _ loader.Loader = (*Loader)(nil)
+
+// New constructs a new OCI loader periodically pulling a bundle from a
+// registry, activating it in the target: an OPA instance, or a source of
+// a composite loader.
+func New(t loader.Target) *Loader {
+	return newLoader(t)
+}
+
+// newLoader constructs a new OCI loader. This is for tests.
+func newLoader(pd loader.Target) *Loader {
+	return &Loader{
+		pd:       pd,
+		client:   http.DefaultClient,
+		scheme:   "https",
+		minDelay: DefaultMinDelay,
+		maxDelay: DefaultMaxDelay,
+		logError: func(error) {},
+	}
+}
+
+// Init initializes the loader after its construction and
+// configuration. If invalid config, will return ErrInvalidConfig.
+func (l *Loader) Init() (*Loader, error) {
+	if l.configErr != nil {
+		return nil, l.configErr
+	}
+
+	if l.ref.repository == "" {
+		return nil, errors.New(errors.InvalidConfigErr, "missing reference")
+	}
+
+	l.initialized = true
+	return l, nil
+}
+
+// Start starts the periodic pulls, blocking until the first successful
+// pull. If cancelled, will return context.Cancelled. If a bundle was
+// persisted, Start activates it instead and returns right away, the
+// pulls continuing in the background.
+func (l *Loader) Start(ctx context.Context) error {
+	if !l.initialized {
+		return errors.New(errors.NotReadyErr, "")
+	}
+
+	restored, err := l.restore(ctx)
+	if err != nil {
+		l.logError(err)
+	}
+
+	if !restored {
+		if err := l.pull(ctx); err != nil {
+			return err
+		}
+	}
+
+	l.closing = make(chan struct{})
+	l.closed = make(chan struct{})
+
+	go l.poller()
+
+	return nil
+}
+
+// Close stops the pulling, releasing all resources.
+func (l *Loader) Close() {
+	if !l.initialized {
+		return
+	}
+
+	if l.closing == nil {
+		return
+	}
+
+	close(l.closing)
+	<-l.closed
+
+	l.closing = nil
+	l.closed = nil
+}
+
+// Status returns a snapshot of the status of the loader. The ETag is
+// the digest of the manifest of the bundle active.
+func (l *Loader) Status() loader.Status {
+	return l.monitor.Status()
+}
+
+// OnActivate registers a callback invoked with the status of the
+// loader once a bundle is activated. The callbacks run in the loading
+// goroutine, hence must not load.
+func (l *Loader) OnActivate(callback func(loader.Status)) {
+	l.monitor.OnActivate(callback)
+}
+
+// poller periodically pulls the bundle. A bundle pinned by digest never
+// changes, hence is pulled only once.
+func (l *Loader) poller() {
+	defer close(l.closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-l.closing
+		cancel()
+	}()
+
+	for {
+		if err := l.pull(ctx); err != nil {
+			break
+		}
+
+		if l.ref.digest != "" {
+			<-ctx.Done()
+			return
+		}
+
+		delay := time.Duration(float64((l.maxDelay-l.minDelay))*rand.Float64()) + l.minDelay
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pull blocks until a bundle has been pulled successfully or the
+// context is cancelled. No other error besides context.Canceled is
+// ever returned.
+func (l *Loader) pull(ctx context.Context) error {
+	for retry := 0; true; retry++ {
+		if err := l.Load(ctx); err == context.Canceled {
+			return err
+		} else if err != nil {
+			l.logError(err)
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(loader.Backoff(float64(MinRetryDelay), float64(l.maxDelay), retry)):
+		case <-ctx.Done():
+			return context.Canceled
+		}
+	}
+
+	return nil
+}
+
+// Load pulls the bundle from the registry and installs it. The bundle
+// layer is pulled only if the manifest changed since the bundle
+// installed. The possible returned errors are ErrInvalidBundle (in case
+// of an error in pulling or opening the bundle, a digest mismatch, or a
+// signature verification failure)
+// and the ones SetPoliciesData of OPA returns. All the wasm modules of
+// the bundle are installed. Delta bundles are not supported. If
+// persisting, the bundle installed is persisted, a failure to do so
+// being only logged.
+func (l *Loader) Load(ctx context.Context) error {
+	if !l.initialized {
+		return errors.New(errors.NotReadyErr, "")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.load(ctx); err != nil {
+		l.monitor.Failed(err)
+		return err
+	}
+
+	l.monitor.Succeeded()
+	return nil
+}
+
+// load pulls the bundle and installs it, if changed.
+func (l *Loader) load(ctx context.Context) error {
+	// A bundle pinned by digest never changes.
+	if l.ref.digest != "" && l.digest == l.ref.digest {
+		return nil
+	}
+
+	m, digest, err := l.getManifest(ctx)
+	if err != nil {
+		return errors.New(errors.InvalidBundleErr, fmt.Sprintf("%s: %v", l.ref, err))
+	}
+
+	if digest == l.digest {
+		return nil
+	}
+
+	var layer *descriptor
+	for i := range m.Layers {
+		if !bundleMediaTypes[m.Layers[i].MediaType] {
+			continue
+		}
+
+		if layer != nil {
+			return errors.New(errors.InvalidBundleErr, fmt.Sprintf("%s: several bundle layers", l.ref))
+		}
+		layer = &m.Layers[i]
+	}
+
+	if layer == nil {
+		return errors.New(errors.InvalidBundleErr, fmt.Sprintf("%s: missing bundle layer", l.ref))
+	}
+
+	raw, err := l.getBlob(ctx, *layer)
+	if err != nil {
+		return errors.New(errors.InvalidBundleErr, fmt.Sprintf("%s: %v", l.ref, err))
+	}
+
+	revision, err := l.install(ctx, raw)
+	if err != nil {
+		return err
+	}
+
+	l.digest = digest
+	l.monitor.Activated(revision, digest)
+
+	if l.persist != "" {
+		err := l.persist.SaveSnapshot(raw)
+		if err == nil {
+			err = l.persist.SaveTag(digest)
+		}
+
+		if err != nil {
+			l.logError(errors.New(errors.InternalErr, fmt.Sprintf("persist bundle: %v", err)))
+		}
+	}
+
+	return nil
+}
+
+// restore installs the bundle persisted, if any. It returns true if it
+// was installed. The manifest digest persisted with the bundle spares
+// pulling it again, if not changed since.
+func (l *Loader) restore(ctx context.Context) (bool, error) {
+	if l.persist == "" {
+		return false, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	raw, _, err := l.persist.Load()
+	if err != nil {
+		return false, errors.New(errors.InternalErr, fmt.Sprintf("restore bundle: %v", err))
+	} else if raw == nil {
+		return false, nil
+	}
+
+	digest, err := l.persist.Tag()
+	if err != nil {
+		return false, errors.New(errors.InternalErr, fmt.Sprintf("restore bundle: %v", err))
+	}
+
+	revision, err := l.install(ctx, raw)
+	if err != nil {
+		return false, err
+	}
+
+	l.digest = digest
+	l.monitor.Activated(revision, digest)
+	return true, nil
+}
+
+// install opens and installs a bundle, verifying its signatures if
+// configured, returning its revision.
+func (l *Loader) install(ctx context.Context, raw []byte) (string, error) {
+	b, err := loader.ReadBundle(raw, l.verification)
+	if err != nil {
+		return "", err
+	}
+
+	if b.Type() == bundle.DeltaBundleType {
+		return "", errors.New(errors.InvalidBundleErr, "delta bundles not supported")
+	}
+
+	if err := loader.Activate(ctx, l.pd, loader.Snapshot(b)); err != nil {
+		return "", err
+	}
+
+	return b.Manifest.Revision, nil
+}
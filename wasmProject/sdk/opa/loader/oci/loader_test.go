@@ -0,0 +1,535 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build opa_wasm
+// +build opa_wasm
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+func TestOCILoader(t *testing.T) {
+	reg := newTestRegistry("user", "secret")
+	defer reg.Close()
+
+	policy := "wasm-policy"
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+	reg.Push("org/bundle", "latest", policy, data)
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).
+		WithReference(reg.Host()+"/org/bundle").
+		WithPlainHTTP().
+		WithCredentials("user", "secret").
+		WithInterval(10*time.Millisecond, 20*time.Millisecond).
+		Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	defer loader.Close()
+
+	pd.CheckEqual(t, policy, &data)
+
+	// The token obtained is reused, and the unchanged bundle not
+	// installed again.
+
+	blobs := reg.Blobs()
+	time.Sleep(100 * time.Millisecond)
+
+	if tokens := reg.Tokens(); tokens != 1 {
+		t.Fatalf("expected a token requested once, got %d", tokens)
+	}
+
+	if reg.Blobs() != blobs || pd.Sets() != 1 {
+		t.Fatal("unchanged bundle pulled again")
+	}
+
+	// Reload with updated contents.
+
+	policy = "wasm-policy-modified"
+	data = map[string]interface{}{
+		"bar": "foo",
+	}
+
+	sets := pd.Sets()
+	reg.Push("org/bundle", "latest", policy, data)
+
+	pd.WaitUpdate(sets)
+	pd.CheckEqual(t, policy, &data)
+}
+
+func TestOCILoaderAuth(t *testing.T) {
+	reg := newTestRegistry("user", "secret")
+	defer reg.Close()
+
+	reg.Push("org/bundle", "v1", "wasm-policy", map[string]interface{}{})
+
+	for _, tc := range []struct {
+		note   string
+		config func(*Loader) *Loader
+	}{
+		{"no credentials", func(l *Loader) *Loader { return l }},
+		{"invalid credentials", func(l *Loader) *Loader { return l.WithCredentials("user", "invalid") }},
+		{"invalid token", func(l *Loader) *Loader { return l.WithToken("invalid") }},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			var pd testPolicyData
+			loader, err := tc.config(newLoader(&pd).WithReference(reg.Host() + "/org/bundle:v1").WithPlainHTTP()).Init()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+				t.Fatalf("expected invalid bundle error, got: %v", err)
+			}
+		})
+	}
+
+	// A token configured is used as is.
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithReference(reg.Host() + "/org/bundle:v1").WithPlainHTTP().WithToken(reg.Token()).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	if tokens := reg.Tokens(); tokens != 0 {
+		t.Fatalf("expected no token requested, got %d", tokens)
+	}
+}
+
+func TestOCILoaderDigest(t *testing.T) {
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+	digest := reg.Push("org/bundle", "latest", "wasm-policy", data)
+	reg.Push("org/bundle", "latest", "wasm-policy-modified", map[string]interface{}{})
+
+	// The bundle pinned is loaded, despite the tag moving on, and not
+	// pulled again.
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithReference(reg.Host() + "/org/bundle@" + digest).WithPlainHTTP().Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := loader.Load(context.Background()); err != nil {
+			t.Fatalf("unable to load: %v", err)
+		}
+	}
+
+	pd.CheckEqual(t, "wasm-policy", &data)
+	if sets := pd.Sets(); sets != 1 {
+		t.Fatalf("expected the bundle installed once, got %d", sets)
+	}
+
+	// Content not matching its digest is rejected.
+
+	reg.Tamper(digest)
+
+	loader, err = newLoader(&pd).WithReference(reg.Host() + "/org/bundle@" + digest).WithPlainHTTP().Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("expected digest mismatch error, got: %v", err)
+	}
+
+	// Invalid references are rejected.
+
+	for _, ref := range []string{"bundle", reg.Host() + "/org/bundle@sha256:1234", reg.Host() + "/org/bundle:"} {
+		if _, err := newLoader(&pd).WithReference(ref).Init(); !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+			t.Fatalf("%s: expected invalid config error, got: %v", ref, err)
+		}
+	}
+}
+
+func TestOCILoaderVerification(t *testing.T) {
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	signed := bundle.Bundle{
+		Data:        map[string]interface{}{"foo": "bar"},
+		WasmModules: []bundle.WasmModuleFile{{URL: "/policy.wasm", Path: "/policy.wasm", Raw: []byte("wasm-policy")}},
+	}
+	if err := signed.GenerateSignature(bundle.NewSigningConfig("secret", "HS256", ""), "foo", false); err != nil {
+		panic(err)
+	}
+
+	tampered := signed
+	tampered.WasmModules = []bundle.WasmModuleFile{{URL: "/policy.wasm", Path: "/policy.wasm", Raw: []byte("wasm-policy-tampered")}}
+
+	unsigned := signed
+	unsigned.Signatures = bundle.SignaturesConfig{}
+
+	tests := []struct {
+		note   string
+		bundle bundle.Bundle
+		key    string
+		valid  bool
+	}{
+		{"signed", signed, "secret", true},
+		{"wrong key", signed, "other", false},
+		{"tampered", tampered, "secret", false},
+		{"unsigned", unsigned, "secret", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.note, func(t *testing.T) {
+			reg.PushBundle("org/bundle", "latest", test.bundle)
+
+			var pd testPolicyData
+			loader, err := newLoader(&pd).WithReference(reg.Host()+"/org/bundle").WithPlainHTTP().WithVerificationKey("foo", test.key, "HS256").Init()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			err = loader.Load(context.Background())
+			if test.valid && err != nil {
+				t.Fatalf("unable to load: %v", err)
+			} else if !test.valid && !goerrors.Is(err, &errors.Error{Code: errors.InvalidBundleErr}) {
+				t.Fatalf("expected invalid bundle error, got: %v", err)
+			}
+		})
+	}
+
+	if _, err := newLoader(&testPolicyData{}).WithReference(reg.Host()+"/org/bundle").WithVerificationKey("foo", "secret", "XX256").Init(); !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("expected invalid config error, got: %v", err)
+	}
+}
+
+func TestOCILoaderPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-oci-loader")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	reg := newTestRegistry("", "")
+	var data interface{} = map[string]interface{}{
+		"foo": "bar",
+	}
+	reg.Push("org/bundle", "latest", "wasm-policy", data)
+
+	var pd testPolicyData
+	loader, err := newLoader(&pd).WithReference(reg.Host() + "/org/bundle").WithPlainHTTP().WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	// The bundle persisted is not pulled again, if not changed since.
+
+	var unchanged testPolicyData
+	loader, err = newLoader(&unchanged).WithReference(reg.Host() + "/org/bundle").WithPlainHTTP().WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := loader.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	if err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+
+	loader.Close()
+
+	if blobs := reg.Blobs(); blobs != 1 {
+		t.Fatalf("expected the bundle pulled once, got %d", blobs)
+	}
+
+	if sets := unchanged.Sets(); sets != 1 {
+		t.Fatalf("expected the bundle installed once, got %d", sets)
+	}
+
+	// Start with the registry down: the bundle persisted is activated
+	// right away.
+
+	reg.Close()
+
+	var restored testPolicyData
+	loader, err = newLoader(&restored).WithReference(reg.Host() + "/org/bundle").WithPlainHTTP().WithPersistDir(dir).Init()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := loader.Start(ctx); err != nil {
+		t.Fatalf("unable to start loader: %v", err)
+	}
+
+	defer loader.Close()
+
+	restored.CheckEqual(t, "wasm-policy", &data)
+}
+
+// testRegistry is an OCI distribution registry, serving the manifests
+// and blobs pushed. If credentials are given, it requires a bearer token
+// from its token service, which authenticates with them.
+type testRegistry struct {
+	*httptest.Server
+	sync.Mutex
+	username  string
+	password  string
+	manifests map[string][]byte // Manifests by repository and tag or digest.
+	blobs     map[string][]byte // Blobs by digest.
+	tokens    int               // Number of tokens requested.
+	pulls     int               // Number of blobs pulled.
+}
+
+func newTestRegistry(username, password string) *testRegistry {
+	r := &testRegistry{
+		username:  username,
+		password:  password,
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *testRegistry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *testRegistry) Token() string {
+	return "token-" + r.username
+}
+
+func (r *testRegistry) Tokens() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.tokens
+}
+
+func (r *testRegistry) Blobs() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.pulls
+}
+
+// Push pushes a bundle under a tag, returning the manifest digest.
+func (r *testRegistry) Push(repository, tag, policy string, data interface{}) string {
+	return r.PushBundle(repository, tag, bundle.Bundle{
+		Data: data.(map[string]interface{}),
+		Wasm: []byte(policy),
+	})
+}
+
+// PushBundle pushes a bundle under a tag, returning the manifest digest.
+func (r *testRegistry) PushBundle(repository, tag string, b bundle.Bundle) string {
+	var buf bytes.Buffer
+	if err := bundle.NewWriter(&buf).Write(b); err != nil {
+		panic(err)
+	}
+
+	layer := descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: digestOf(buf.Bytes()), Size: int64(buf.Len())}
+	config := descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: digestOf([]byte("{}")), Size: 2}
+	raw, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestMediaType,
+		"config":        config,
+		"layers":        []descriptor{layer},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	digest := digestOf(raw)
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.blobs[layer.Digest] = buf.Bytes()
+	r.blobs[config.Digest] = []byte("{}")
+	r.manifests[repository+":"+tag] = raw
+	r.manifests[repository+"@"+digest] = raw
+	return digest
+}
+
+// Tamper modifies the manifests stored under the digest.
+func (r *testRegistry) Tamper(digest string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for ref, raw := range r.manifests {
+		if strings.HasSuffix(ref, "@"+digest) {
+			r.manifests[ref] = append(raw, ' ')
+		}
+	}
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.URL.Path == "/token" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if req.URL.Query().Get("scope") != "repository:org/bundle:pull" || req.URL.Query().Get("service") != "test" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.tokens++
+		fmt.Fprintf(w, `{"token": %q}`, r.Token())
+		return
+	}
+
+	if r.username != "" && req.Header.Get("Authorization") != "Bearer "+r.Token() {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:org/bundle:pull"`, r.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		sep := ":"
+		if strings.HasPrefix(parts[1], "sha256:") {
+			sep = "@"
+		}
+
+		raw, ok := r.manifests[parts[0]+sep+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", manifestMediaType)
+		_, _ = w.Write(raw)
+	case strings.Contains(path, "/blobs/"):
+		raw, ok := r.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		r.pulls++
+		_, _ = w.Write(raw)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type testPolicyData struct {
+	sync.Mutex
+	policies [][]byte
+	data     *interface{}
+	sets     int // Number of SetPoliciesData calls.
+	updated  chan struct{}
+}
+
+func (pd *testPolicyData) SetPoliciesData(_ context.Context, policies [][]byte, data *interface{}) error {
+	pd.Lock()
+	defer pd.Unlock()
+
+	pd.policies = policies
+	pd.data = data
+	pd.sets++
+	if pd.updated != nil {
+		close(pd.updated)
+		pd.updated = nil
+	}
+
+	return nil
+}
+
+// SetDataPath, RemoveDataPath and PatchData are not used, as delta
+// bundles are not supported.
+func (pd *testPolicyData) SetDataPath(context.Context, []string, interface{}) error {
+	return fmt.Errorf("not supported")
+}
+
+func (pd *testPolicyData) RemoveDataPath(context.Context, []string) error {
+	return fmt.Errorf("not supported")
+}
+
+func (pd *testPolicyData) PatchData(context.Context, []opa.PatchOp) error {
+	return fmt.Errorf("not supported")
+}
+
+func (pd *testPolicyData) CheckEqual(t *testing.T, policy string, data *interface{}) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	if len(pd.policies) != 1 || !bytes.Equal([]byte(policy), pd.policies[0]) || !reflect.DeepEqual(data, pd.data) {
+		t.Fatal("policy/data mismatch.")
+	}
+}
+
+func (pd *testPolicyData) Sets() int {
+	pd.Lock()
+	defer pd.Unlock()
+
+	return pd.sets
+}
+
+// WaitUpdate waits for SetPoliciesData to be called more than sets
+// times.
+func (pd *testPolicyData) WaitUpdate(sets int) {
+	for {
+		pd.Lock()
+		if pd.sets > sets {
+			pd.Unlock()
+			return
+		}
+
+		updated := make(chan struct{})
+		pd.updated = updated
+		pd.Unlock()
+
+		<-updated
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// manifestMediaType is the media type of the OCI image manifests.
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+	// dockerManifestMediaType is the media type of the Docker image
+	// manifests, the registries may convert the OCI ones to.
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// maxManifestSize bounds the size of the manifests read.
+	maxManifestSize = 4 << 20
+)
+
+// bundleMediaTypes are the media types of the layers holding a bundle.
+var bundleMediaTypes = map[string]bool{
+	"application/vnd.oci.image.layer.v1.tar+gzip":       true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip": true,
+}
+
+// manifest is an image manifest, as far as used.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// descriptor describes the content of a blob.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// validDigest returns true if the digest is a well-formed sha256 digest,
+// the only algorithm supported.
+func validDigest(digest string) bool {
+	hash := strings.TrimPrefix(digest, "sha256:")
+	if len(hash) != sha256.Size*2 || hash == digest {
+		return false
+	}
+
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// digestOf returns the sha256 digest of the content.
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// getManifest pulls the manifest of the reference. It returns the
+// manifest with its digest, matching the pinned digest if any.
+func (l *Loader) getManifest(ctx context.Context) (*manifest, string, error) {
+	ref := l.ref.tag
+	if l.ref.digest != "" {
+		ref = l.ref.digest
+	}
+
+	resp, err := l.get(ctx, "manifests/"+ref, manifestMediaType+", "+dockerManifestMediaType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer l.close(resp)
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(raw) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s: too large", ref)
+	}
+
+	digest := digestOf(raw)
+	if l.ref.digest != "" && digest != l.ref.digest {
+		return nil, "", fmt.Errorf("manifest %s: digest mismatch, got %s", ref, digest)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, "", fmt.Errorf("manifest %s: %w", ref, err)
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = resp.Header.Get("Content-Type")
+	}
+
+	if mediaType != manifestMediaType && mediaType != dockerManifestMediaType {
+		return nil, "", fmt.Errorf("manifest %s: unsupported media type %s", ref, mediaType)
+	}
+
+	return &m, digest, nil
+}
+
+// getBlob pulls a blob, verifying its size and digest.
+func (l *Loader) getBlob(ctx context.Context, desc descriptor) ([]byte, error) {
+	if !validDigest(desc.Digest) {
+		return nil, fmt.Errorf("blob %s: invalid digest", desc.Digest)
+	}
+
+	resp, err := l.get(ctx, "blobs/"+desc.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+
+	defer l.close(resp)
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(raw)) != desc.Size {
+		return nil, fmt.Errorf("blob %s: size mismatch", desc.Digest)
+	}
+
+	if digestOf(raw) != desc.Digest {
+		return nil, fmt.Errorf("blob %s: digest mismatch", desc.Digest)
+	}
+
+	return raw, nil
+}
+
+// get executes HTTP GET on a path of the repository. If the registry
+// asks for authentication, it authenticates and retries once. The
+// bearer token obtained is kept for the later requests.
+func (l *Loader) get(ctx context.Context, path string, accept string) (*http.Response, error) {
+	u := fmt.Sprintf("%s://%s/v2/%s/%s", l.scheme, l.ref.registry, l.ref.repository, path)
+
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		switch {
+		case l.bearer != "":
+			req.Header.Set("Authorization", "Bearer "+l.bearer)
+		case l.basic:
+			req.SetBasicAuth(l.username, l.password)
+		}
+
+		resp, err := l.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp, nil
+		case http.StatusUnauthorized:
+			l.close(resp)
+
+			if retry > 0 || l.token != "" {
+				return nil, fmt.Errorf("%s: not authorized (401)", path)
+			}
+
+			if err := l.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		default:
+			l.close(resp)
+			return nil, fmt.Errorf("%s: unexpected HTTP status %v", path, resp.StatusCode)
+		}
+	}
+}
+
+// authenticate answers the challenge of the registry: it requests a
+// bearer token from the token service the registry points to, or falls
+// back to basic authentication.
+func (l *Loader) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if l.username == "" {
+			return fmt.Errorf("basic authentication without credentials")
+		}
+
+		l.basic = true
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	} else {
+		query.Set("scope", "repository:"+l.ref.repository+":pull")
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if l.username != "" {
+		req.SetBasicAuth(l.username, l.password)
+	}
+
+	resp, err := l.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer l.close(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token service: unexpected HTTP status %v", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("token service: %w", err)
+	}
+
+	l.bearer = token.Token
+	if l.bearer == "" {
+		l.bearer = token.AccessToken
+	}
+
+	if l.bearer == "" {
+		return fmt.Errorf("token service: missing token")
+	}
+
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, as in Bearer
+// realm="https://auth.example.com/token",service="registry". The scheme
+// is returned in lower case.
+func parseChallenge(challenge string) (string, map[string]string) {
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return strings.ToLower(challenge), nil
+	}
+
+	scheme, rest := strings.ToLower(challenge[:i]), challenge[i+1:]
+	params := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return scheme, params
+		}
+
+		key, value := strings.ToLower(strings.TrimSpace(rest[:eq])), rest[eq+1:]
+		if strings.HasPrefix(value, `"`) {
+			var b bytes.Buffer
+			j := 1
+			for ; j < len(value) && value[j] != '"'; j++ {
+				if value[j] == '\\' && j+1 < len(value) {
+					j++
+				}
+				b.WriteByte(value[j])
+			}
+			if j < len(value) {
+				j++ // Closing quote.
+			}
+			params[key], rest = b.String(), value[j:]
+		} else {
+			end := strings.IndexByte(value, ',')
+			if end < 0 {
+				end = len(value)
+			}
+			params[key], rest = strings.TrimSpace(value[:end]), value[end:]
+		}
+	}
+}
+
+// close closes the HTTP response gracefully, first draining it, to
+// avoid resource leaks.
+func (l *Loader) close(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body) // Ignore errors.
+	_ = resp.Body.Close()
+}
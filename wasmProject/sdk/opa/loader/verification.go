@@ -0,0 +1,71 @@
+// Copyright 2022 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package loader
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/keys"
+)
+
+// VerificationKey returns the configuration verifying the bundle
+// signatures with a single key: a PEM encoded public key (e.g. RS256,
+// ES256) or the secret of an HMAC algorithm (e.g. HS256). The algorithm
+// defaults to RS256. The error is ErrInvalidConfig. This is for the
+// loaders' WithVerificationKey.
+func VerificationKey(keyID, key, alg string) (*bundle.VerificationConfig, error) {
+	if alg == "" {
+		alg = "RS256"
+	}
+
+	if keyID == "" || key == "" {
+		return nil, errors.New(errors.InvalidConfigErr, "missing verification key")
+	}
+
+	if !keys.IsSupportedAlgorithm(alg) {
+		return nil, errors.New(errors.InvalidConfigErr, fmt.Sprintf("unsupported verification algorithm %s", alg))
+	}
+
+	return bundle.NewVerificationConfig(map[string]*bundle.KeyConfig{
+		keyID: {Key: key, Algorithm: alg},
+	}, keyID, "", nil), nil
+}
+
+// VerificationConfig validates a configuration verifying the bundle
+// signatures, as in the OPA bundle configuration, injecting its
+// defaults. The error is ErrInvalidConfig. This is for the loaders'
+// WithVerificationConfig.
+func VerificationConfig(config *bundle.VerificationConfig) (*bundle.VerificationConfig, error) {
+	if config == nil {
+		return nil, errors.New(errors.InvalidConfigErr, "missing verification config")
+	}
+
+	if err := config.ValidateAndInjectDefaults(config.PublicKeys); err != nil {
+		return nil, errors.New(errors.InvalidConfigErr, err.Error())
+	}
+
+	return config, nil
+}
+
+// ReadBundle opens a bundle, verifying its signatures if a verification
+// is configured: unsigned bundles, or bundles not matching their
+// signatures, are rejected. The error is ErrInvalidBundle.
+func ReadBundle(raw []byte, verification *bundle.VerificationConfig) (*bundle.Bundle, error) {
+	// TODO: Cut the dependency to the OPA bundle package.
+
+	b, err := bundle.NewReader(bytes.NewReader(raw)).WithBundleVerificationConfig(verification).Read()
+	if err != nil {
+		return nil, errors.New(errors.InvalidBundleErr, err.Error())
+	}
+
+	if verification != nil && len(b.Signatures.Signatures) == 0 {
+		return nil, errors.New(errors.InvalidBundleErr, "missing signatures")
+	}
+
+	return &b, nil
+}
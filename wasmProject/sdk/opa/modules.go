@@ -0,0 +1,79 @@
+// Copyright 2020 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package opa
+
+import (
+	"fmt"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+)
+
+// modules are the policy modules evaluated, each by a pool of its own.
+// A bundle built for several entrypoint sets carries a module per set.
+//
+// The entrypoint IDs exposed are global: the IDs of a module are offset
+// by the number of entrypoints of the modules before it. With a single
+// module they are the IDs of the module.
+type modules struct {
+	pools   []*wasm.Pool
+	routes  map[string]int   // Index of the pool exporting the entrypoint, by name.
+	offsets []int32          // First entrypoint ID of each pool.
+	ids     map[string]int32 // Global entrypoint IDs, by name.
+}
+
+// newModules indexes the entrypoints of the pools, as exported by the
+// policies of the pools, in order. It returns ErrInvalidPolicyOrData if
+// several modules export the same entrypoint.
+func newModules(pools []*wasm.Pool, entrypoints []map[string]int32) (*modules, error) {
+	m := &modules{
+		pools:   pools,
+		routes:  make(map[string]int),
+		offsets: make([]int32, len(pools)),
+		ids:     make(map[string]int32),
+	}
+
+	var offset int32
+	for i := range pools {
+		m.offsets[i] = offset
+		next := offset
+		for name, id := range entrypoints[i] {
+			if _, ok := m.routes[name]; ok {
+				return nil, errors.New(errors.InvalidPolicyOrDataErr, fmt.Sprintf("entrypoint %s exported by several modules", name))
+			}
+			m.routes[name] = i
+			m.ids[name] = offset + id
+			if offset+id >= next {
+				next = offset + id + 1
+			}
+		}
+		offset = next
+	}
+
+	return m, nil
+}
+
+// route returns the pool evaluating the entrypoint, with the ID of the
+// entrypoint within the module. A name takes precedence over an ID, and
+// is left to resolve against the VM acquired.
+func (m *modules) route(name string, id int32) (*wasm.Pool, int32, error) {
+	if len(m.pools) == 0 {
+		return nil, 0, errNotReady
+	}
+
+	if name != "" {
+		i, ok := m.routes[name]
+		if !ok {
+			return nil, 0, errors.New(errors.InvalidEntrypointErr, name)
+		}
+		return m.pools[i], 0, nil
+	}
+
+	i := len(m.offsets) - 1
+	for i > 0 && id < m.offsets[i] {
+		i--
+	}
+	return m.pools[i], id - m.offsets[i], nil
+}
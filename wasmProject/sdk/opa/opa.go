@@ -7,9 +7,11 @@ package opa
 import (
 	"context"
 	"encoding/json"
+	goerrors "errors"
 	"io"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/internal/wasm"
@@ -17,6 +19,7 @@ import (
 	sdk_errors "github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/metrics"
+	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/topdown/print"
 )
@@ -25,20 +28,26 @@ var errNotReady = errors.New(errors.NotReadyErr, "")
 
 // OPA executes WebAssembly compiled Rego policies.
 type OPA struct {
-	configErr      error // Delayed configuration error, if any.
-	memoryMinPages uint32
-	memoryMaxPages uint32 // 0 means no limit.
-	poolSize       uint32
-	pool           *wasm.Pool
-	mutex          sync.Mutex // To serialize access to SetPolicy, SetData and Close.
-	policy         []byte     // Current policy.
-	data           []byte     // Current data.
-	logError       func(error)
-}
-
-// Result holds the evaluation result.
-type Result struct {
-	Result []byte
+	revision        uint64 // Current data revision, accessed atomically hence first for the alignment.
+	configErr       error  // Delayed configuration error, if any.
+	memoryMinPages  uint32
+	memoryMaxPages  uint32 // 0 means no limit.
+	poolSize        uint32
+	poolMinSize     uint32        // VMs built at initialization and kept if idle, per pool.
+	poolIdleTimeout time.Duration // Idle time after which VMs are closed, 0 if never.
+	recycleEvals    uint32        // Evaluations after which VMs are rebuilt, 0 if never.
+	recycleMemory   uint32        // Memory size, in bytes, beyond which VMs are rebuilt, 0 if never.
+	modules         atomic.Value  // Current *modules, set once initialized.
+	mutex           sync.Mutex    // To serialize access to SetPolicy, SetData and Close.
+	policies        [][]byte      // Current policy modules.
+	data            []byte        // Current data.
+	logError        func(error)
+	boolUndefined   BoolFallback
+	boolNonBoolean  BoolFallback
+	boolMultiple    BoolFallback
+	strict          bool                           // Strict builtin errors mode.
+	builtins        map[string]topdown.BuiltinFunc // Custom builtins, by name.
+	engine          string                         // Name of the Wasm engine.
 }
 
 // New constructs a new OPA SDK instance, ready to be configured with
@@ -51,7 +60,12 @@ func New() *OPA {
 		memoryMinPages: 16,
 		memoryMaxPages: 0x10000, // 4GB
 		poolSize:       uint32(runtime.GOMAXPROCS(0)),
+		poolMinSize:    1,
 		logError:       func(error) {},
+		boolUndefined:  FallbackDeny,
+		boolNonBoolean: FallbackError,
+		boolMultiple:   FallbackError,
+		engine:         EngineWazero,
 	}
 
 	return opa
@@ -66,10 +80,14 @@ func (o *OPA) Init() (*OPA, error) {
 		return nil, o.configErr
 	}
 
-	o.pool = wasm.NewPool(o.poolSize, o.memoryMinPages, o.memoryMaxPages)
+	if o.poolMinSize > o.poolSize {
+		return nil, errors.New(errors.InvalidConfigErr, "pool minimum size exceeds the pool size")
+	}
+
+	o.modules.Store(&modules{})
 
-	if len(o.policy) != 0 {
-		if err := o.pool.SetPolicyData(ctx, o.policy, o.data); err != nil {
+	if len(o.policies) != 0 {
+		if err := o.setPolicyData(ctx, o.policies, o.data); err != nil {
 			return nil, err
 		}
 	}
@@ -77,11 +95,34 @@ func (o *OPA) Init() (*OPA, error) {
 	return o, nil
 }
 
+// newPool constructs a pool for a policy module, as configured.
+func (o *OPA) newPool() (*wasm.Pool, error) {
+	pool := wasm.NewPool(o.poolSize, o.memoryMinPages, o.memoryMaxPages)
+	if o.engine != wasm.DefaultEngine {
+		if err := pool.SetEngine(o.engine); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+	pool.SetStrictBuiltinErrors(o.strict)
+	pool.SetBuiltins(o.builtins)
+	pool.SetMinSize(o.poolMinSize)
+	pool.SetIdleTimeout(o.poolIdleTimeout)
+	pool.SetRecycling(o.recycleEvals, o.recycleMemory)
+	return pool, nil
+}
+
+// loadModules returns the current modules, nil if not initialized.
+func (o *OPA) loadModules() *modules {
+	m, _ := o.modules.Load().(*modules)
+	return m
+}
+
 // SetData updates the data for the subsequent Eval calls.  Returns
 // either ErrNotReady, ErrInvalidPolicyOrData, or ErrInternal if an
 // error occurs.
 func (o *OPA) SetData(ctx context.Context, v interface{}) error {
-	if o.pool == nil {
+	if o.loadModules() == nil {
 		return errNotReady
 	}
 
@@ -93,45 +134,171 @@ func (o *OPA) SetData(ctx context.Context, v interface{}) error {
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	return o.setPolicyData(ctx, o.policy, raw)
+	return o.setPolicyData(ctx, o.policies, raw)
 }
 
 // SetDataPath will update the current data on the VMs by setting the value at the
 // specified path. If an error occurs the instance is still in a valid state, however
-// the data will not have been modified.
+// the data will not have been modified: the update is prepared on all
+// the VMs before any observes it, as the next data revision.
 func (o *OPA) SetDataPath(ctx context.Context, path []string, value interface{}) error {
-	return o.pool.SetDataPath(ctx, path, value)
+	return o.updateData(func(pool *wasm.Pool) (*wasm.Update, error) {
+		return pool.PrepareDataPath(ctx, path, value)
+	})
 }
 
 // RemoveDataPath will update the current data on the VMs by removing the value at the
 // specified path. If an error occurs the instance is still in a valid state, however
-// the data will not have been modified.
+// the data will not have been modified: the update is prepared on all
+// the VMs before any observes it, as the next data revision.
 func (o *OPA) RemoveDataPath(ctx context.Context, path []string) error {
-	return o.pool.RemoveDataPath(ctx, path)
+	return o.updateData(func(pool *wasm.Pool) (*wasm.Update, error) {
+		return pool.PrepareRemoveDataPath(ctx, path)
+	})
+}
+
+// The operations of a data patch.
+const (
+	PatchAdd     = wasm.PatchAdd
+	PatchRemove  = wasm.PatchRemove
+	PatchReplace = wasm.PatchReplace
+)
+
+// PatchOp is an operation of a data patch, JSON Patch-style.
+type PatchOp struct {
+	// Op is either PatchAdd, setting the value at the path and creating
+	// the missing parents, PatchReplace, setting the value at the path
+	// which must exist, or PatchRemove, removing the value at the path
+	// which must exist.
+	Op    string
+	Path  []string
+	Value interface{} // Unused by PatchRemove.
+}
+
+// PatchData updates the current data on the VMs by applying the
+// operations in order, as a single data revision: either all the
+// operations are applied, or none. The data is patched once per pool,
+// the VMs being rebuilt from it. Returns either ErrNotReady,
+// ErrInvalidPolicyOrData if an operation is invalid, or ErrInternal.
+func (o *OPA) PatchData(ctx context.Context, ops []PatchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	patch := make([]wasm.PatchOp, len(ops))
+	for i, op := range ops {
+		patch[i] = wasm.PatchOp{Op: op.Op, Path: op.Path, Value: op.Value}
+	}
+
+	return o.updateData(func(pool *wasm.Pool) (*wasm.Update, error) {
+		return pool.PreparePatch(ctx, patch)
+	})
+}
+
+// DataRevision returns the current data revision, incremented by every
+// policy or data update. The evaluation results report the revision of
+// the data evaluated.
+func (o *OPA) DataRevision() uint64 {
+	return atomic.LoadUint64(&o.revision)
+}
+
+// updateData prepares a data update on the pools of all the modules,
+// and then commits it. If any fails to prepare, none is updated.
+func (o *OPA) updateData(prepare func(pool *wasm.Pool) (*wasm.Update, error)) error {
+	if o.loadModules() == nil {
+		return errNotReady
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pools := o.loadModules().pools
+	if len(pools) == 0 {
+		return errNotReady
+	}
+
+	updates := make([]*wasm.Update, 0, len(pools))
+	for _, pool := range pools {
+		u, err := prepare(pool)
+		if err != nil {
+			abort(updates)
+			return err
+		}
+		updates = append(updates, u)
+	}
+
+	return o.commit(updates)
+}
+
+// commit commits the updates prepared, as the next data revision. The
+// commits fail only if the pools got closed meanwhile, which the mutex
+// held prevents. Without any update, e.g. data set before any policy,
+// the revision is left as is.
+func (o *OPA) commit(updates []*wasm.Update) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	revision := atomic.LoadUint64(&o.revision) + 1
+
+	var err error
+	for _, u := range updates {
+		if e := u.Commit(revision); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&o.revision, revision)
+	return nil
+}
+
+// abort aborts the updates prepared.
+func abort(updates []*wasm.Update) {
+	for _, u := range updates {
+		u.Abort()
+	}
 }
 
 // SetPolicy updates the policy for the subsequent Eval calls.
 // Returns either ErrNotReady, ErrInvalidPolicy or ErrInternal if an
 // error occurs.
 func (o *OPA) SetPolicy(ctx context.Context, p []byte) error {
-	if o.pool == nil {
+	if o.loadModules() == nil {
 		return errNotReady
 	}
 
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	return o.setPolicyData(ctx, p, o.data)
+	return o.setPolicyData(ctx, [][]byte{p}, o.data)
 }
 
 // SetPolicyData updates both the policy and data for the subsequent
 // Eval calls.  Returns either ErrNotReady, ErrInvalidPolicyOrData, or
 // ErrInternal if an error occurs.
 func (o *OPA) SetPolicyData(ctx context.Context, policy []byte, data *interface{}) error {
-	if o.pool == nil {
+	return o.SetPoliciesData(ctx, [][]byte{policy}, data)
+}
+
+// SetPoliciesData updates the policy modules and data for the
+// subsequent Eval calls. Each module is evaluated by a pool of VMs of
+// its own, Eval routing to the module exporting the entrypoint. The
+// entrypoints must be exported by a single module. Returns either
+// ErrNotReady, ErrInvalidPolicyOrData, or ErrInternal if an error
+// occurs.
+func (o *OPA) SetPoliciesData(ctx context.Context, policies [][]byte, data *interface{}) error {
+	if o.loadModules() == nil {
 		return errNotReady
 	}
 
+	if len(policies) == 0 {
+		return sdk_errors.New(sdk_errors.InvalidPolicyOrDataErr, "missing policy")
+	}
+
 	var raw []byte
 	if data != nil {
 		var err error
@@ -144,15 +311,63 @@ func (o *OPA) SetPolicyData(ctx context.Context, policy []byte, data *interface{
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	return o.setPolicyData(ctx, policy, raw)
+	return o.setPolicyData(ctx, policies, raw)
 }
 
-func (o *OPA) setPolicyData(ctx context.Context, policy []byte, data []byte) error {
-	if err := o.pool.SetPolicyData(ctx, policy, data); err != nil {
+// setPolicyData sets the policy modules and data on the pools, reusing
+// the pools of the current modules in order. The update is prepared on
+// all the pools before committed: if any fails, none is updated.
+func (o *OPA) setPolicyData(ctx context.Context, policies [][]byte, data []byte) error {
+	current := o.loadModules()
+	pools := make([]*wasm.Pool, len(policies))
+	n := copy(pools, current.pools)
+	updates := make([]*wasm.Update, 0, len(policies))
+	entrypoints := make([]map[string]int32, len(policies))
+
+	rollback := func() {
+		abort(updates)
+		for _, pool := range pools[n:] {
+			if pool != nil {
+				pool.Close()
+			}
+		}
+	}
+
+	for i, policy := range policies {
+		if i >= n {
+			pool, err := o.newPool()
+			if err != nil {
+				rollback()
+				return err
+			}
+			pools[i] = pool
+		}
+
+		u, err := pools[i].PreparePolicyData(ctx, policy, data)
+		if err != nil {
+			rollback()
+			return err
+		}
+		updates = append(updates, u)
+		entrypoints[i] = u.Entrypoints()
+	}
+
+	m, err := newModules(pools, entrypoints)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	if err := o.commit(updates); err != nil {
 		return err
 	}
 
-	o.policy = policy
+	o.modules.Store(m)
+	for _, pool := range current.pools[n:] {
+		pool.Close()
+	}
+
+	o.policies = policies
 	o.data = data
 	return nil
 }
@@ -160,6 +375,7 @@ func (o *OPA) setPolicyData(ctx context.Context, policy []byte, data []byte) err
 // EvalOpts define options for performing an evaluation
 type EvalOpts struct {
 	Entrypoint             int32
+	EntrypointName         string // Entrypoint path, e.g. "example/allow". Takes precedence over Entrypoint.
 	Input                  *interface{}
 	Metrics                metrics.Metrics
 	Time                   time.Time
@@ -171,10 +387,14 @@ type EvalOpts struct {
 
 // Eval evaluates the policy with the given input, returning the
 // evaluation results. If no policy was configured at construction
-// time nor set after, the function returns ErrNotReady.  It returns
-// ErrInternal if any other error occurs.
+// time nor set after, the function returns ErrNotReady. If the
+// entrypoint named is not exported by the policy, it returns
+// ErrInvalidEntrypoint. It returns ErrInternal if any other error
+// occurs. The evaluations preempted by the cancellation of another
+// are retried, up to maxPreemptions times.
 func (o *OPA) Eval(ctx context.Context, opts EvalOpts) (*Result, error) {
-	if o.pool == nil {
+	modules := o.loadModules()
+	if modules == nil {
 		return nil, errNotReady
 	}
 
@@ -183,44 +403,161 @@ func (o *OPA) Eval(ctx context.Context, opts EvalOpts) (*Result, error) {
 		m = metrics.New()
 	}
 
-	instance, err := o.pool.Acquire(ctx, m)
-	if err != nil {
-		return nil, err
+	for n := 0; ; n++ {
+		var result *Result
+		var err error
+		modules, result, err = o.eval(ctx, modules, opts, m)
+		if n < maxPreemptions && goerrors.Is(err, wasm.ErrPreempted) {
+			continue
+		}
+		return result, err
 	}
+}
+
+// maxPreemptions is the number of times an evaluation is retried on
+// another VM, if preempted.
+const maxPreemptions = 3
+
+// eval evaluates the policy on a VM acquired from the pool routed to,
+// returning the policy modules routed against.
+func (o *OPA) eval(ctx context.Context, modules *modules, opts EvalOpts, m metrics.Metrics) (*modules, *Result, error) {
+	var pool *wasm.Pool
+	var entrypoint int32
+	var instance *wasm.VM
+	for {
+		var err error
+		pool, entrypoint, err = modules.route(opts.EntrypointName, opts.Entrypoint)
+		if err != nil {
+			return modules, nil, err
+		}
 
-	defer o.pool.Release(instance, m)
+		instance, err = pool.Acquire(ctx, m)
+		if err == nil {
+			break
+		}
+
+		// The pool got retired by a policy update meanwhile, route again.
+		if next := o.loadModules(); next != modules && errors.IsNotReady(err) {
+			modules = next
+			continue
+		}
+		return modules, nil, err
+	}
+
+	defer pool.Release(instance, m)
+
+	// Resolve the name against the VM acquired: its policy is the one
+	// evaluated, even if the pool policy got updated meanwhile.
+	if opts.EntrypointName != "" {
+		id, ok := instance.Entrypoints()[opts.EntrypointName]
+		if !ok {
+			return modules, nil, errors.New(errors.InvalidEntrypointErr, opts.EntrypointName)
+		}
+		entrypoint = id
+	}
 
-	result, err := instance.Eval(ctx, opts.Entrypoint, opts.Input, m, opts.Seed, opts.Time, opts.InterQueryBuiltinCache,
+	result, err := instance.Eval(ctx, entrypoint, opts.Input, m, opts.Seed, opts.Time, opts.InterQueryBuiltinCache,
 		opts.PrintHook, opts.Capabilities)
 	if err != nil {
-		return nil, err
+		return modules, nil, err
 	}
 
-	return &Result{Result: result}, nil
+	r, err := newResult(result, instance.DataRevision())
+	return modules, r, err
+}
+
+// EvalBool evaluates the policy with the given input, returning its
+// boolean decision. Undefined results, non-boolean decisions and
+// multiple results either deny or fail, as configured with
+// WithBoolFallback. Besides the errors of Eval, it returns ErrUndefined
+// or ErrInvalidResult for the results configured to fail.
+func (o *OPA) EvalBool(ctx context.Context, opts EvalOpts) (bool, error) {
+	r, err := o.Eval(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case r.Undefined():
+		return fallback(o.boolUndefined, errors.New(errors.UndefinedErr, ""))
+	case len(r.Set) > 1:
+		return fallback(o.boolMultiple, errors.New(errors.InvalidResultErr, "multiple results"))
+	}
+
+	allowed, err := r.Bool()
+	if err != nil {
+		return fallback(o.boolNonBoolean, err)
+	}
+
+	return allowed, nil
+}
+
+func fallback(f BoolFallback, err error) (bool, error) {
+	if f == FallbackDeny {
+		return false, nil
+	}
+
+	return false, err
 }
 
 // Close waits until all the pending evaluations complete and then
 // releases all the resources allocated. Eval will return ErrClosed
 // afterwards.
 func (o *OPA) Close() {
-	if o.pool == nil {
+	m := o.loadModules()
+	if m == nil {
 		return
 	}
 
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	o.pool.Close()
+	for _, pool := range o.loadModules().pools {
+		pool.Close()
+	}
+}
+
+// PoolStats are the numbers of WASM instances of the pools.
+type PoolStats struct {
+	Live  int // Instances built, idle or in use.
+	Idle  int // Instances available for evaluations.
+	InUse int // Instances evaluating.
+
+	// Draining is the number of instances evaluating with a previous
+	// policy or data, closed once done.
+	Draining int
+
+	// Recycled is the number of instances rebuilt so far, as worn out.
+	Recycled int
+}
+
+// PoolStats returns the current numbers of WASM instances, summed over
+// the pools of the policy modules.
+func (o *OPA) PoolStats() PoolStats {
+	var stats PoolStats
+	m := o.loadModules()
+	if m == nil {
+		return stats
+	}
+
+	for _, pool := range m.pools {
+		s := pool.Stats()
+		stats.Live += s.Live
+		stats.Idle += s.Idle
+		stats.InUse += s.InUse
+		stats.Draining += s.Draining
+		stats.Recycled += s.Recycled
+	}
+	return stats
 }
 
 // Entrypoints returns a mapping of entrypoint name to ID for use by Eval() and EvalBool().
+// With several policy modules, the IDs of each module follow the ones of the previous.
 func (o *OPA) Entrypoints(ctx context.Context) (map[string]int32, error) {
-	instance, err := o.pool.Acquire(ctx, metrics.New())
-	if err != nil {
-		return nil, err
+	m := o.loadModules()
+	if m == nil || len(m.pools) == 0 {
+		return nil, errNotReady
 	}
 
-	defer o.pool.Release(instance, metrics.New())
-
-	return instance.Entrypoints(), nil
+	return m.ids, nil
 }
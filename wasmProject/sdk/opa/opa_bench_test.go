@@ -13,46 +13,14 @@ import (
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util/test"
-	"os"
 	"strings"
+	"sync"
 	"testing"
 )
 
-const PageSize = 65535
-
-func compileRegoToWasm(module string, query string, dump bool) []byte {
-	if !strings.HasPrefix(module, "package") {
-		module = fmt.Sprintf("package p\n%s", module)
-	}
-	opts := []func(*rego.Rego){
-		rego.Query(query),
-		rego.Module("module.rego", module),
-	}
-	if dump {
-		opts = append(opts, rego.Dump(os.Stderr))
-	}
-	cr, err := rego.New(opts...).Compile(context.Background(), rego.CompilePartial(false))
-	if err != nil {
-		panic(err)
-	}
-
-	return cr.Bytes
-}
-func compileRego(module string, query string) rego.PreparedEvalQuery {
-	rego := rego.New(
-		rego.Query(query),
-		rego.Module("module.rego", module),
-	)
-	pq, err := rego.PrepareForEval(context.Background())
-	if err != nil {
-		panic(err)
-	}
-
-	return pq
-}
 func BenchmarkWasmRego(b *testing.B) {
 	policy := compileRegoToWasm("a = true", "data.p.a = x", false)
-	instance, _ := opa.New().
+	instance, _ := newOPA().
 		WithPolicyBytes(policy).
 		WithPoolSize(1).
 		Init()
@@ -94,6 +62,130 @@ func BenchmarkWasmCompilation(b *testing.B) {
 	}
 }
 
+func BenchmarkWASMPoolColdStart(b *testing.B) {
+	// rand.intn reads the seed at runtime, which lets the evaluations
+	// rendezvous while each of them holds a VM of its own.
+	policy := compileRegoToWasm(`a = rand.intn("x", 10)`, "data.p.a = x", false)
+	for _, n := range []int{16, 32, 64} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				instance, err := newOPA().
+					WithPolicyBytes(policy).
+					WithPoolSize(uint32(n)).
+					Init()
+				if err != nil {
+					b.Fatalf("init sdk: %v", err)
+				}
+
+				var ready, done sync.WaitGroup
+				ready.Add(n)
+				for j := 0; j < n; j++ {
+					done.Add(1)
+					go func() {
+						defer done.Done()
+						if _, err := instance.Eval(ctx, opa.EvalOpts{Seed: &seedBarrier{wg: &ready}}); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				done.Wait()
+				instance.Close()
+			}
+		})
+	}
+}
+
+// seedBarrier blocks the first read until all the evaluations sharing
+// the wait group have started.
+type seedBarrier struct {
+	wg   *sync.WaitGroup
+	once sync.Once
+}
+
+func (s *seedBarrier) Read(p []byte) (int, error) {
+	s.once.Do(func() {
+		s.wg.Done()
+		s.wg.Wait()
+	})
+	return len(p), nil
+}
+
+// BenchmarkWASMLargeInput evaluates a policy echoing its input, hence
+// the input is written to and the result read from the memory in bulk.
+func BenchmarkWASMLargeInput(b *testing.B) {
+	policy := compileRegoToWasm("a = input", "data.p.a = x", false)
+	for _, n := range []int{1000, 10000, 100000, 1000000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			instance, err := newOPA().
+				WithPolicyBytes(policy).
+				WithPoolSize(1).
+				Init()
+			if err != nil {
+				b.Fatalf("init sdk: %v", err)
+			}
+
+			defer instance.Close()
+
+			ctx := context.Background()
+			var input interface{} = strings.Repeat("a", n)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := instance.Eval(ctx, opa.EvalOpts{Input: &input}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWASMLargeData initializes a pool with the data, the second
+// VM seeded with the data segment cloned from the first.
+func BenchmarkWASMLargeData(b *testing.B) {
+	policy := compileRegoToWasm("a = count(data.xs)", "data.p.a = x", false)
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			xs := make([]string, n)
+			for i := range xs {
+				xs[i] = fmt.Sprint(i)
+			}
+
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				instance, err := newOPA().
+					WithPolicyBytes(policy).
+					WithDataJSON(map[string]interface{}{"xs": xs}).
+					WithPoolSize(2).
+					Init()
+				if err != nil {
+					b.Fatalf("init sdk: %v", err)
+				}
+
+				var wg sync.WaitGroup
+				for j := 0; j < 2; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := instance.Eval(ctx, opa.EvalOpts{}); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+				instance.Close()
+			}
+		})
+	}
+}
+
 func BenchmarkWASMArrayIteration(b *testing.B) {
 	sizes := []int{10, 100, 1000, 10000}
 	for _, n := range sizes {
@@ -127,7 +219,7 @@ func benchmarkIteration(b *testing.B, module string) {
 	query := "data.test.main = x"
 	policy := compileRegoToWasm(module, query, false)
 
-	instance, err := opa.New().
+	instance, err := newOPA().
 		WithPolicyBytes(policy).
 		WithMemoryLimits(2*PageSize, 47*PageSize).
 		WithPoolSize(1).
@@ -145,7 +237,7 @@ func benchmarkIteration(b *testing.B, module string) {
 		if err != nil {
 			b.Fatalf("Unexpected query error: %v", err)
 		}
-		if string(r.Result) != `{{"x":true}}` {
+		if string(r.Result) != `[{"x":true}]` {
 			b.Errorf("unexpected result: %s", string(r.Result))
 		}
 	}
@@ -168,7 +260,7 @@ func BenchmarkWASMLargeJSON(b *testing.B) {
 			query := "data.keys[_] = x; data.values = y"
 			policy := compileRegoToWasm("", query, false)
 
-			instance, err := opa.New().
+			instance, err := newOPA().
 				WithPolicyBytes(policy).
 				WithDataJSON(data).
 				WithMemoryLimits(200*PageSize, 600*PageSize). // This is rather much
@@ -217,7 +309,7 @@ func runVirtualDocsBenchmark(b *testing.B, numTotalRules, numHitRules int) {
 
 	policy := compileRegoToWasm(module, query, false)
 
-	instance, err := opa.New().
+	instance, err := newOPA().
 		WithPolicyBytes(policy).
 		WithMemoryLimits(8*PageSize, 8*PageSize).
 		WithPoolSize(1).
@@ -9,19 +9,36 @@ package opa_test
 
 import (
 	"context"
+	goerrors "errors"
+	"flag"
 	"fmt"
 	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa"
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/types"
 	"github.com/open-policy-agent/opa/util"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
-const PageSize = 65535
+const PageSize = 65536
+
+// engine runs the tests on another engine, e.g. with the wasmtime build tag:
+//
+//	go test -tags opa_wasm,wasmtime ./sdk/opa -args -engine=wasmtime
+var engine = flag.String("engine", opa.EngineWazero, "wasm engine to test")
+
+// newOPA returns an OPA instance running on the engine tested.
+func newOPA() *opa.OPA {
+	return opa.New().WithEngine(*engine)
+}
 
 // control dumping in this file
 const dump = false
@@ -50,8 +67,8 @@ func TestOPA(t *testing.T) {
 			Policy:      `a = true`,
 			Query:       "data.p.a = x",
 			Evals: []Eval{
-				{Result: `{{"x": true}}`},
-				{Result: `{{"x": true}}`},
+				{Result: `[{"x": true}]`},
+				{Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -59,8 +76,8 @@ func TestOPA(t *testing.T) {
 			Policy:      `a = input`,
 			Query:       "data.p.a = x",
 			Evals: []Eval{
-				{Input: "false", Result: `{{"x": false}}`},
-				{Input: "true", Result: `{{"x": true}}`},
+				{Input: "false", Result: `[{"x": false}]`},
+				{Input: "true", Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -69,8 +86,8 @@ func TestOPA(t *testing.T) {
 			Query:       "data.p.a = x",
 			Data:        `{"q": false}`,
 			Evals: []Eval{
-				{Result: `{{"x": false}}`},
-				{NewData: `{"q": true}`, Result: `{{"x": true}}`},
+				{Result: `[{"x": false}]`},
+				{NewData: `{"q": true}`, Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -79,8 +96,8 @@ func TestOPA(t *testing.T) {
 			Query:       "data.p.a = x",
 			Data:        `{"q": false, "r": true}`,
 			Evals: []Eval{
-				{Result: `{{"x": false}}`},
-				{NewPolicy: `a = data.r`, Result: `{{"x": true}}`},
+				{Result: `[{"x": false}]`},
+				{NewPolicy: `a = data.r`, Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -89,8 +106,8 @@ func TestOPA(t *testing.T) {
 			Query:       "data.p.a = x",
 			Data:        `{"q": 0, "r": 1}`,
 			Evals: []Eval{
-				{Result: `{{"x": 0}}`},
-				{NewPolicy: `a = data.r`, NewData: `{"q": 2, "r": 3}`, Result: `{{"x": 3}}`},
+				{Result: `[{"x": 0}]`},
+				{NewPolicy: `a = data.r`, NewData: `{"q": 2, "r": 3}`, Result: `[{"x": 3}]`},
 			},
 		},
 		{
@@ -98,8 +115,8 @@ func TestOPA(t *testing.T) {
 			Policy:      `a = count(data.q) + sum(data.q)`, // builtin not implemented in wasm.
 			Query:       "data.p.a = x",
 			Evals: []Eval{
-				{NewData: `{"q": []}`, Result: `{{"x": 0}}`},
-				{NewData: `{"q": [1, 2]}`, Result: `{{"x": 5}}`},
+				{NewData: `{"q": []}`, Result: `[{"x": 0}]`},
+				{NewData: `{"q": [1, 2]}`, Result: `[{"x": 5}]`},
 			},
 		},
 		{
@@ -107,7 +124,7 @@ func TestOPA(t *testing.T) {
 			Policy:      `a = true`,
 			Query:       "data.p.b = x",
 			Evals: []Eval{
-				{Result: `{}`},
+				{Result: `[]`},
 			},
 		},
 		{
@@ -172,8 +189,8 @@ a = "c" { input > 2 }`,
 			}`,
 			Query: "data.p.hello = x",
 			Evals: []Eval{
-				{Input: `{"message": "xxxxxxx"}`, Result: `{{"x": false}}`},
-				{Input: `{"message": "world"}`, Result: `{{"x": true}}`},
+				{Input: `{"message": "xxxxxxx"}`, Result: `[{"x": false}]`},
+				{Input: `{"message": "world"}`, Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -185,22 +202,22 @@ a = "c" { input > 2 }`,
 			}`,
 			Query: "data.p.hello = x",
 			Evals: []Eval{
-				{Input: `{"message": "xxxxxxx"}`, Result: `{{"x": false}}`},
-				{Input: `{"message": "world"}`, Result: `{{"x": true}}`},
+				{Input: `{"message": "xxxxxxx"}`, Result: `[{"x": false}]`},
+				{Input: `{"message": "world"}`, Result: `[{"x": true}]`},
 			},
 		},
 		{
 			Description: "regex.match with pattern from input",
 			Query:       `x = regex.match(input.re, "foo")`,
 			Evals: []Eval{
-				{Input: `{"re": "^foo$"}`, Result: `{{"x": true}}`},
+				{Input: `{"re": "^foo$"}`, Result: `[{"x": true}]`},
 			},
 		},
 		{
 			Description: "regex.find_all_string_submatch_n with pattern from input",
 			Query:       `x = regex.find_all_string_submatch_n(input.re, "-axxxbyc-", -1)`,
 			Evals: []Eval{
-				{Input: `{"re": "a(x*)b(y|z)c"}`, Result: `{{"x":[["axxxbyc","xxx","y"]]}}`},
+				{Input: `{"re": "a(x*)b(y|z)c"}`, Result: `[{"x":[["axxxbyc","xxx","y"]]}]`},
 			},
 		},
 		{
@@ -209,7 +226,7 @@ a = "c" { input > 2 }`,
 			Policy: `p = 1
 			q = 2`,
 			Evals: []Eval{
-				{Result: `{{"y": 2, "x": "q"}}`},
+				{Result: `[{"y": 2, "x": "q"}]`},
 			},
 		},
 		{
@@ -217,8 +234,8 @@ a = "c" { input > 2 }`,
 			Query:       `data.p.main = x`,
 			Policy:      `main { numbers.range(1, 2)[_] == 2 }`,
 			Evals: []Eval{
-				{Result: `{{"x": true}}`},
-				{Result: `{{"x": true}}`},
+				{Result: `[{"x": true}]`},
+				{Result: `[{"x": true}]`},
 			},
 		},
 		{
@@ -227,7 +244,7 @@ a = "c" { input > 2 }`,
 			c = 3`,
 			Query: `data == {"a": {"b": {"c": 3 }}}`,
 			Evals: []Eval{
-				{Result: `{{}}`},
+				{Result: `[{}]`},
 			},
 		},
 		{
@@ -259,7 +276,7 @@ a = "c" { input > 2 }`,
 			Query:  `data.a.b.p = x`,
 			Memory: []uint32{2, 8},
 			Evals: []Eval{
-				{Input: largeInput, Result: `{{"x":true}}`},
+				{Input: largeInput, Result: `[{"x":true}]`},
 			},
 		},
 	}
@@ -273,7 +290,7 @@ a = "c" { input > 2 }`,
 			if len(data) == 0 {
 				data = nil
 			}
-			o := opa.New().
+			o := newOPA().
 				WithPolicyBytes(policy).
 				WithDataBytes(data).
 				WithPoolSize(1) // Minimal pool size to test pooling.
@@ -364,7 +381,7 @@ func TestNamedEntrypoint(t *testing.T) {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
-	instance, err := opa.New().
+	instance, err := newOPA().
 		WithPolicyBytes(compiler.Bundle().WasmModules[0].Raw).
 		WithPoolSize(1).
 		Init()
@@ -386,7 +403,7 @@ func TestNamedEntrypoint(t *testing.T) {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
-	exp := ast.MustParseTerm(`{{"result":7}}`)
+	exp := ast.MustParseTerm(`[{"result":7}]`)
 	actual := ast.MustParseTerm(string(a.Result))
 	if !actual.Equal(exp) {
 		t.Fatalf("Expected result for 'test/a' to be %s, got: %s", exp, actual)
@@ -403,6 +420,838 @@ func TestNamedEntrypoint(t *testing.T) {
 	}
 }
 
+func TestEvalEntrypointName(t *testing.T) {
+	module := `package test
+
+	a = 7
+	b = 8
+	`
+
+	ctx := context.Background()
+
+	instance, err := newOPA().
+		WithPolicyBytes(compileEntrypoints(t, module, "test/a", "test/b")).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	eval := func(name string, expected string) {
+		t.Helper()
+
+		r, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: name})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		exp := ast.MustParseTerm(expected)
+		if actual := ast.MustParseTerm(string(r.Result)); !actual.Equal(exp) {
+			t.Fatalf("Expected result for '%s' to be %s, got: %s", name, exp, actual)
+		}
+	}
+
+	eval("test/a", `[{"result":7}]`)
+	eval("test/b", `[{"result":8}]`)
+
+	// Swap the entrypoint IDs, the names keep resolving to the same rules.
+	if err := instance.SetPolicy(ctx, compileEntrypoints(t, module, "test/b", "test/a")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	eval("test/a", `[{"result":7}]`)
+	eval("test/b", `[{"result":8}]`)
+
+	_, err = instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/c"})
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidEntrypointErr}) {
+		t.Fatalf("Expected invalid entrypoint error, got: %v", err)
+	}
+}
+
+func TestEvalResult(t *testing.T) {
+	module := `package test
+
+	allow = true
+	deny { false }
+	user = {"name": "alice", "roles": ["admin"]}
+	`
+
+	ctx := context.Background()
+	policy := compileEntrypoints(t, module, "test/allow", "test/deny", "test/user")
+
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	eps, err := instance.Entrypoints(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r, err := instance.Eval(ctx, opa.EvalOpts{Entrypoint: eps["test/allow"]})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if r.Undefined() {
+		t.Fatal("Expected 'test/allow' to be defined")
+	}
+
+	if allowed, err := r.Bool(); err != nil || !allowed {
+		t.Fatalf("Expected 'test/allow' to be true, got: %v (err: %v)", allowed, err)
+	}
+
+	r, err = instance.Eval(ctx, opa.EvalOpts{Entrypoint: eps["test/deny"]})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if !r.Undefined() {
+		t.Fatalf("Expected 'test/deny' to be undefined, got: %s", r.Result)
+	}
+
+	if _, err := r.Bool(); !errors.IsUndefined(err) {
+		t.Fatalf("Expected undefined error, got: %v", err)
+	}
+
+	r, err = instance.Eval(ctx, opa.EvalOpts{Entrypoint: eps["test/user"]})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var user struct {
+		Name  string   `json:"name"`
+		Roles []string `json:"roles"`
+	}
+	if err := r.Decode(&user); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if user.Name != "alice" || len(user.Roles) != 1 || user.Roles[0] != "admin" {
+		t.Fatalf("Unexpected decoded result: %+v", user)
+	}
+
+	if _, err := r.Bool(); !errors.IsError(err) || errors.IsUndefined(err) {
+		t.Fatalf("Expected invalid result error, got: %v", err)
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	module := `package test
+
+	allow = true
+	deny = false
+	undefined { false }
+	name = "alice"
+	`
+
+	ctx := context.Background()
+	policy := compileEntrypoints(t, module, "test/allow", "test/deny", "test/undefined", "test/name")
+	multiple := compileRegoToWasm(`a = {"x", "y"}`, "data.p.a[x]", dump)
+
+	tests := []struct {
+		note       string
+		policy     []byte
+		entrypoint string
+		fallback   opa.BoolFallback
+		expected   bool
+		wantErr    string
+	}{
+		{note: "true", policy: policy, entrypoint: "test/allow", expected: true},
+		{note: "false", policy: policy, entrypoint: "test/deny", expected: false},
+		{note: "undefined, deny", policy: policy, entrypoint: "test/undefined", fallback: opa.FallbackDeny},
+		{note: "undefined, error", policy: policy, entrypoint: "test/undefined", fallback: opa.FallbackError, wantErr: errors.UndefinedErr},
+		{note: "non-boolean, deny", policy: policy, entrypoint: "test/name", fallback: opa.FallbackDeny},
+		{note: "non-boolean, error", policy: policy, entrypoint: "test/name", fallback: opa.FallbackError, wantErr: errors.InvalidResultErr},
+		{note: "multiple, deny", policy: multiple, fallback: opa.FallbackDeny},
+		{note: "multiple, error", policy: multiple, fallback: opa.FallbackError, wantErr: errors.InvalidResultErr},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			instance, err := newOPA().
+				WithPolicyBytes(tc.policy).
+				WithPoolSize(1).
+				WithBoolFallback(tc.fallback, tc.fallback, tc.fallback).
+				Init()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			defer instance.Close()
+
+			eps, err := instance.Entrypoints(ctx)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			allowed, err := instance.EvalBool(ctx, opa.EvalOpts{Entrypoint: eps[tc.entrypoint]})
+			if tc.wantErr != "" {
+				if !goerrors.Is(err, &errors.Error{Code: tc.wantErr}) {
+					t.Fatalf("Expected %s error, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if allowed != tc.expected {
+				t.Fatalf("Expected %v, got: %v", tc.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestEvalCancel(t *testing.T) {
+	// The loop never terminates in practice: the engine must stop it at
+	// the deadline, abandoning it would block the garbage collection.
+	module := `package test
+
+	xs := numbers.range(1, 10000)
+	loop {
+		xs[a]
+		xs[b]
+		xs[c]
+		a > b
+		b > a
+	}
+	ok = true
+	`
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	instance, err := newOPA().
+		WithPolicyBytes(compileEntrypoints(t, module, "test/loop", "test/ok")).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/loop"})
+	if !errors.IsCancel(err) {
+		t.Fatalf("Expected cancelled error, got: %v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the evaluation to stop at the deadline, took %v", d)
+	}
+
+	start = time.Now()
+	runtime.GC()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the evaluation stopped, the garbage collection took %v", d)
+	}
+
+	// The VM running the cancelled evaluation is replaced.
+	allowed, err := instance.EvalBool(context.Background(), opa.EvalOpts{EntrypointName: "test/ok"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if !allowed {
+		t.Fatalf("Expected true")
+	}
+}
+
+func TestEvalCancelBuiltin(t *testing.T) {
+	wait := &ast.Builtin{
+		Name: "custom.wait",
+		Decl: types.NewFunction(types.Args(types.S), types.S),
+	}
+	policy := compileWithBuiltins(t, `package test
+
+	p = custom.wait("x")`, []*ast.Builtin{wait}, "test/p")
+
+	// The builtin runs until cancelled, through topdown.Cancel.
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithPoolSize(1).
+		WithBuiltin(wait.Name, wait.Decl, func(bctx topdown.BuiltinContext, _ []*ast.Term, _ func(*ast.Term) error) error {
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				if bctx.Cancel.Cancelled() {
+					return topdown.Halt{Err: &topdown.Error{Code: topdown.CancelErr, Message: "custom.wait: cancelled"}}
+				}
+			}
+			return nil
+		}).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/p"}); !errors.IsCancel(err) {
+		t.Fatalf("Expected cancelled error, got: %v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the builtin to stop at the deadline, took %v", d)
+	}
+}
+
+func TestEvalCancelConcurrent(t *testing.T) {
+	// The loop terminates, after a while.
+	module := `package test
+
+	xs := numbers.range(1, 150)
+	loop {
+		xs[a]
+		xs[b]
+		xs[c]
+		a > b
+		b > a
+	}
+	`
+
+	instance, err := newOPA().
+		WithPolicyBytes(compileEntrypoints(t, module, "test/loop")).
+		WithPoolSize(2).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := instance.Eval(context.Background(), opa.EvalOpts{EntrypointName: "test/loop"})
+		done <- err
+	}()
+
+	// Cancelling an evaluation leaves the ones running on the other VMs
+	// intact.
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/loop"}); !errors.IsCancel(err) {
+		t.Fatalf("Expected cancelled error, got: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestEvalCancelPreempted(t *testing.T) {
+	// The loop terminates, after a while.
+	module := `package test
+
+	xs := numbers.range(1, 150)
+	loop {
+		xs[a]
+		xs[b]
+		xs[c]
+		a > b
+		b > a
+	}
+	`
+
+	instance, err := newOPA().
+		WithPolicyBytes(compileEntrypoints(t, module, "test/loop")).
+		WithPoolSize(2).
+		WithPoolMinSize(2).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	// An evaluation interruptible too is retried if the engine preempts
+	// it, as it interrupts the one cancelled.
+	running, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	done := make(chan error)
+	go func() {
+		_, err := instance.Eval(running, opa.EvalOpts{EntrypointName: "test/loop"})
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/loop"}); !errors.IsCancel(err) {
+		t.Fatalf("Expected cancelled error, got: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestStrictBuiltinErrors(t *testing.T) {
+	module := `package test
+
+	p = time.parse_rfc3339_ns("not a time")
+	`
+	policy := compileEntrypoints(t, module, "test/p")
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			instance, err := newOPA().
+				WithPolicyBytes(policy).
+				WithPoolSize(1).
+				WithStrictBuiltinErrors(strict).
+				Init()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			defer instance.Close()
+
+			result, err := instance.Eval(context.Background(), opa.EvalOpts{EntrypointName: "test/p"})
+			if strict {
+				if !goerrors.Is(err, &errors.Error{Code: errors.BuiltinErr}) {
+					t.Fatalf("Expected builtin error, got: %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if !result.Undefined() {
+				t.Fatalf("Expected undefined result, got: %s", result.Result)
+			}
+		})
+	}
+}
+
+func TestUnsupportedBuiltin(t *testing.T) {
+	module := `package test
+
+	p = custom.greet("world")
+	`
+	policy := compileWithBuiltins(t, module, []*ast.Builtin{greet}, "test/p")
+
+	_, err := newOPA().
+		WithPolicyBytes(policy).
+		WithPoolSize(1).
+		Init()
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidPolicyOrDataErr}) {
+		t.Fatalf("Expected invalid policy error, got: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "custom.greet") {
+		t.Fatalf("Expected the builtin in the error, got: %v", err)
+	}
+}
+
+func TestWithBuiltin(t *testing.T) {
+	module := `package test
+
+	p = custom.greet(input.name)
+	`
+	policy := compileWithBuiltins(t, module, []*ast.Builtin{greet}, "test/p")
+
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithPoolSize(2).
+		WithBuiltin(greet.Name, greet.Decl, func(_ topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			name, ok := operands[0].Value.(ast.String)
+			if !ok {
+				return fmt.Errorf("name: not a string")
+			}
+			return iter(ast.StringTerm("hello, " + string(name)))
+		}).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	for _, name := range []string{"alice", "bob"} {
+		var input interface{} = map[string]interface{}{"name": name}
+		result, err := instance.Eval(context.Background(), opa.EvalOpts{EntrypointName: "test/p", Input: &input})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if expected := fmt.Sprintf(`[{"result":"hello, %s"}]`, name); string(result.Result) != expected {
+			t.Fatalf("Expected %s, got: %s", expected, result.Result)
+		}
+	}
+
+	_, err = newOPA().WithBuiltin("custom.none", nil, nil).Init()
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("Expected invalid config error, got: %v", err)
+	}
+
+	// The ABI dispatches builtins of up to four arguments.
+	five := types.NewFunction(types.Args(types.N, types.N, types.N, types.N, types.N), types.N)
+	_, err = newOPA().WithBuiltin("custom.five", five, func(topdown.BuiltinContext, []*ast.Term, func(*ast.Term) error) error {
+		return nil
+	}).Init()
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) || !strings.Contains(err.Error(), "more than 4 arguments") {
+		t.Fatalf("Expected invalid config error, got: %v", err)
+	}
+}
+
+func TestPolicyModules(t *testing.T) {
+	a := compileEntrypoints(t, `package a
+	p = data.x
+	q = "q"`, "a/p", "a/q")
+	b := compileEntrypoints(t, `package b
+	p = concat(" ", [data.x, input])`, "b/p")
+
+	ctx := context.Background()
+	instance, err := newOPA().WithPoolSize(1).Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer instance.Close()
+
+	var data interface{} = map[string]interface{}{"x": "hello"}
+	if err := instance.SetPoliciesData(ctx, [][]byte{a, b}, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	entrypoints, err := instance.Entrypoints(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(entrypoints) != 3 || entrypoints["b/p"] != 2 {
+		t.Fatalf("Unexpected entrypoints: %v", entrypoints)
+	}
+
+	var input interface{} = "world"
+	for _, test := range []struct {
+		opts     opa.EvalOpts
+		expected string
+	}{
+		{opa.EvalOpts{EntrypointName: "a/p"}, `[{"result":"hello"}]`},
+		{opa.EvalOpts{EntrypointName: "a/q"}, `[{"result":"q"}]`},
+		{opa.EvalOpts{EntrypointName: "b/p", Input: &input}, `[{"result":"hello world"}]`},
+		{opa.EvalOpts{Entrypoint: entrypoints["a/q"]}, `[{"result":"q"}]`},
+		{opa.EvalOpts{Entrypoint: entrypoints["b/p"], Input: &input}, `[{"result":"hello world"}]`},
+	} {
+		result, err := instance.Eval(ctx, test.opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if string(result.Result) != test.expected {
+			t.Fatalf("Expected %s, got: %s", test.expected, result.Result)
+		}
+	}
+
+	// Data updates reach all the modules.
+
+	if err := instance.SetDataPath(ctx, []string{"x"}, "bye"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	result, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "b/p", Input: &input})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if expected := `[{"result":"bye world"}]`; string(result.Result) != expected {
+		t.Fatalf("Expected %s, got: %s", expected, result.Result)
+	}
+
+	// The modules must not export the same entrypoints, the update is
+	// then rejected as a whole.
+
+	if err := instance.SetPoliciesData(ctx, [][]byte{b, b}, &data); !goerrors.Is(err, &errors.Error{Code: errors.InvalidPolicyOrDataErr}) {
+		t.Fatalf("Expected invalid policy error, got: %v", err)
+	}
+
+	if _, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "a/q"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Back to a single module, the others are retired.
+
+	if err := instance.SetPolicyData(ctx, b, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if _, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "a/q"}); !goerrors.Is(err, &errors.Error{Code: errors.InvalidEntrypointErr}) {
+		t.Fatalf("Expected invalid entrypoint error, got: %v", err)
+	}
+
+	result, err = instance.Eval(ctx, opa.EvalOpts{EntrypointName: "b/p", Input: &input})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if expected := `[{"result":"hello world"}]`; string(result.Result) != expected {
+		t.Fatalf("Expected %s, got: %s", expected, result.Result)
+	}
+}
+
+func TestWithEngine(t *testing.T) {
+	_, err := opa.New().WithEngine("unknown").Init()
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("Expected invalid config error, got: %v", err)
+	}
+}
+
+func TestPoolMinSize(t *testing.T) {
+	policy := compileEntrypoints(t, `package test
+	p = true`, "test/p")
+
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithPoolSize(4).
+		WithPoolMinSize(2).
+		WithPoolIdleTimeout(time.Minute).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	// The minimum is warmed up at initialization already.
+	if stats := instance.PoolStats(); stats != (opa.PoolStats{Live: 2, Idle: 2}) {
+		t.Fatalf("Unexpected pool stats: %+v", stats)
+	}
+
+	result, err := instance.Eval(context.Background(), opa.EvalOpts{EntrypointName: "test/p"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if expected := `[{"result":true}]`; string(result.Result) != expected {
+		t.Fatalf("Expected %s, got: %s", expected, result.Result)
+	}
+
+	_, err = newOPA().WithPoolSize(1).WithPoolMinSize(2).Init()
+	if !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+		t.Fatalf("Expected invalid config error, got: %v", err)
+	}
+
+	for _, timeout := range []time.Duration{-time.Second, time.Nanosecond} {
+		_, err = newOPA().WithPolicyBytes(policy).WithPoolIdleTimeout(timeout).Init()
+		if !goerrors.Is(err, &errors.Error{Code: errors.InvalidConfigErr}) {
+			t.Fatalf("Expected invalid config error for %v, got: %v", timeout, err)
+		}
+	}
+}
+
+func TestDataRevision(t *testing.T) {
+	policy := compileEntrypoints(t, `package test
+	p = data.x`, "test/p")
+
+	ctx := context.Background()
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithDataBytes([]byte(`{"x": {"y": "a"}}`)).
+		WithPoolSize(2).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	check := func(expected string, revision uint64) {
+		t.Helper()
+
+		if r := instance.DataRevision(); r != revision {
+			t.Fatalf("Expected revision %d, got: %d", revision, r)
+		}
+
+		result, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/p"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if string(result.Result) != expected || result.DataRevision != revision {
+			t.Fatalf("Expected %s of revision %d, got: %s of revision %d", expected, revision, result.Result, result.DataRevision)
+		}
+	}
+
+	check(`[{"result":{"y":"a"}}]`, 1)
+
+	if err := instance.SetDataPath(ctx, []string{"x", "y"}, "b"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	check(`[{"result":{"y":"b"}}]`, 2)
+
+	// A failed update leaves the data and its revision as is.
+
+	if err := instance.SetDataPath(ctx, []string{"x", "y", "z"}, "c"); err == nil {
+		t.Fatal("Expected an error patching a string")
+	}
+
+	check(`[{"result":{"y":"b"}}]`, 2)
+
+	if err := instance.RemoveDataPath(ctx, []string{"x", "y"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	check(`[{"result":{}}]`, 3)
+
+	var data interface{} = map[string]interface{}{"x": "d"}
+	if err := instance.SetPolicyData(ctx, policy, &data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	check(`[{"result":"d"}]`, 4)
+
+	// Data set before any policy is kept for the policy set next, without
+	// a revision of its own.
+
+	instance, err = newOPA().WithPoolSize(2).Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	if err := instance.SetData(ctx, map[string]interface{}{"x": "e"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if r := instance.DataRevision(); r != 0 {
+		t.Fatalf("Expected revision 0, got: %d", r)
+	}
+
+	if err := instance.SetDataPath(ctx, []string{"x"}, "f"); err == nil {
+		t.Fatal("Expected an error patching the data without a policy")
+	}
+
+	if err := instance.SetPolicy(ctx, policy); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	check(`[{"result":"e"}]`, 1)
+}
+
+func TestPatchData(t *testing.T) {
+	policy := compileEntrypoints(t, `package test
+	p = data.x`, "test/p")
+
+	ctx := context.Background()
+	instance, err := newOPA().
+		WithPolicyBytes(policy).
+		WithDataBytes([]byte(`{"x": {"a": 1, "b": 2}}`)).
+		WithPoolSize(2).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	defer instance.Close()
+
+	check := func(expected string, revision uint64) {
+		t.Helper()
+
+		result, err := instance.Eval(ctx, opa.EvalOpts{EntrypointName: "test/p"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if string(result.Result) != expected || result.DataRevision != revision {
+			t.Fatalf("Expected %s of revision %d, got: %s of revision %d", expected, revision, result.Result, result.DataRevision)
+		}
+	}
+
+	err = instance.PatchData(ctx, []opa.PatchOp{
+		{Op: opa.PatchAdd, Path: []string{"x", "c", "d"}, Value: 3},
+		{Op: opa.PatchReplace, Path: []string{"x", "a"}, Value: "z"},
+		{Op: opa.PatchRemove, Path: []string{"x", "b"}},
+		{Op: opa.PatchReplace, Path: []string{"x", "c", "d"}, Value: 4},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	check(`[{"result":{"c":{"d":4},"a":"z"}}]`, 2)
+
+	// An invalid operation leaves the data and its revision as is.
+
+	for _, ops := range [][]opa.PatchOp{
+		{{Op: opa.PatchAdd, Path: []string{"x", "e"}, Value: 5}, {Op: opa.PatchReplace, Path: []string{"x", "b"}, Value: 6}},
+		{{Op: opa.PatchAdd, Path: []string{"x", "e"}, Value: 5}, {Op: opa.PatchRemove, Path: []string{"x", "b"}}},
+		{{Op: opa.PatchAdd, Path: []string{"x", "a", "f"}, Value: 7}},
+		{{Op: "move", Path: []string{"x", "a"}}},
+		{{Op: opa.PatchAdd}},
+	} {
+		if err := instance.PatchData(ctx, ops); !goerrors.Is(err, &errors.Error{Code: errors.InvalidPolicyOrDataErr}) {
+			t.Fatalf("Expected invalid policy or data error, got: %v", err)
+		}
+	}
+
+	check(`[{"result":{"c":{"d":4},"a":"z"}}]`, 2)
+}
+
+// greet is a custom builtin, unknown to OPA.
+var greet = &ast.Builtin{
+	Name: "custom.greet",
+	Decl: types.NewFunction(types.Args(types.S), types.S),
+}
+
+// compileEntrypoints compiles the module to a wasm policy exposing the
+// entrypoints.
+func compileEntrypoints(t *testing.T, module string, entrypoints ...string) []byte {
+	t.Helper()
+	return compileWithBuiltins(t, module, nil, entrypoints...)
+}
+
+// compileWithBuiltins compiles the module as compileEntrypoints does,
+// allowing it to call the custom builtins too.
+func compileWithBuiltins(t *testing.T, module string, builtins []*ast.Builtin, entrypoints ...string) []byte {
+	t.Helper()
+
+	caps := ast.CapabilitiesForThisVersion()
+	caps.Builtins = append(caps.Builtins, builtins...)
+
+	compiler := compile.New().
+		WithTarget(compile.TargetWasm).
+		WithCapabilities(caps).
+		WithEntrypoints(entrypoints...).
+		WithBundle(&bundle.Bundle{
+			Modules: []bundle.ModuleFile{
+				{
+					Path:   "policy.rego",
+					URL:    "policy.rego",
+					Raw:    []byte(module),
+					Parsed: ast.MustParseModule(module),
+				},
+			},
+		})
+
+	if err := compiler.Build(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	return compiler.Bundle().WasmModules[0].Raw
+}
+
 // compileRegoToWasm is shared with the benchmarking functions in opa_bench_test.go;
 // those function use helpers shared with topdown_bench_test.go, and they all use
 // `package test` -- whereas the callers in this file don't provide the package at
@@ -0,0 +1,114 @@
+// Copyright 2020 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package opa
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/Kaijlo/OpaGO/wasmProject/sdk/opa/errors"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// resultKey is the binding holding the value of an entrypoint.
+const resultKey = "result"
+
+// ResultSet holds the results of an evaluation, one set of variable
+// bindings per result. The bound values are kept serialized until
+// decoded.
+type ResultSet []map[string]json.RawMessage
+
+// Result holds the evaluation result.
+type Result struct {
+	Result       []byte    // Result set, serialized as JSON.
+	Set          ResultSet // Result set, parsed.
+	DataRevision uint64    // Revision of the data evaluated, see OPA.DataRevision.
+}
+
+// newResult parses the serialized result set returned by a VM, of the
+// data revision.
+func newResult(raw []byte, revision uint64) (*Result, error) {
+	var rs ResultSet
+	if err := json.Unmarshal(raw, &rs); err != nil {
+		return nil, errors.New(errors.InternalErr, "result set: "+err.Error())
+	}
+
+	return &Result{Result: raw, Set: rs, DataRevision: revision}, nil
+}
+
+// Undefined returns true if the evaluation produced no results.
+func (r *Result) Undefined() bool {
+	return len(r.Set) == 0
+}
+
+// Value returns the decision, i.e., the value bound to "result" in
+// the single result of an entrypoint evaluation. Numbers are returned
+// as json.Number. Returns ErrUndefined if the result set is empty and
+// ErrInvalidResult if it holds more than one result or no decision.
+func (r *Result) Value() (interface{}, error) {
+	raw, err := r.decision()
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := util.NewJSONDecoder(bytes.NewReader(raw)).Decode(&v); err != nil {
+		return nil, errors.New(errors.InvalidResultErr, err.Error())
+	}
+
+	return v, nil
+}
+
+// Bool returns the decision as a boolean. Besides the errors of
+// Value, returns ErrInvalidResult if the decision is not a boolean.
+func (r *Result) Bool() (bool, error) {
+	raw, err := r.decision()
+	if err != nil {
+		return false, err
+	}
+
+	switch string(raw) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, errors.New(errors.InvalidResultErr, "decision is not a boolean")
+	}
+}
+
+// Decode unmarshals the decision into the value pointed to by v,
+// following the rules of json.Unmarshal. Besides the errors of Value,
+// returns ErrInvalidResult if the decision does not fit v.
+func (r *Result) Decode(v interface{}) error {
+	raw, err := r.decision()
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errors.New(errors.InvalidResultErr, err.Error())
+	}
+
+	return nil
+}
+
+// decision returns the serialized decision of the single result.
+func (r *Result) decision() (json.RawMessage, error) {
+	switch len(r.Set) {
+	case 0:
+		return nil, errors.New(errors.UndefinedErr, "")
+	case 1:
+	default:
+		return nil, errors.New(errors.InvalidResultErr, "multiple results")
+	}
+
+	raw, ok := r.Set[0][resultKey]
+	if !ok {
+		return nil, errors.New(errors.InvalidResultErr, "missing result")
+	}
+
+	return raw, nil
+}
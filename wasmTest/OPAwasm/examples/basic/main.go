@@ -10,7 +10,7 @@ import (
 	"os"
 	"path"
 
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
+	"wasmTest.skyefall.app/OPAwasm/opa"
 )
 
 // main demonstrates the loading and executing of OPA produced wasm
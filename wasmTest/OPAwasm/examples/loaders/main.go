@@ -11,10 +11,10 @@ import (
 	"os"
 	"time"
 
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
-	opaLoader "github.com/open-policy-agent/opa/internal/wasm/sdk/opa/loader"
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa/loader/file"
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa/loader/http"
+	"wasmTest.skyefall.app/OPAwasm/opa"
+	opaLoader "wasmTest.skyefall.app/OPAwasm/opa/loader"
+	"wasmTest.skyefall.app/OPAwasm/opa/loader/file"
+	"wasmTest.skyefall.app/OPAwasm/opa/loader/http"
 )
 
 var (
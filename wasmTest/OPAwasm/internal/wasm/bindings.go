@@ -17,49 +17,54 @@ import (
 	"time"
 
 	"github.com/bytecodealliance/wasmtime-go"
+
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/builtins"
 	"github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/topdown/print"
-	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/api"
 )
 
-func opaFunctions(d *builtinDispatcher, ctx *context.Context, r *wazero.Runtime) api.Module {
+func opaFunctions(dispatcher *builtinDispatcher, store *wasmtime.Store) map[string]wasmtime.AsExtern {
+
+	i32 := wasmtime.NewValType(wasmtime.KindI32)
 
 	externs := map[string]wasmtime.AsExtern{
-		"opa_abort":    wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32}, nil), opaAbort),
-		"opa_builtin0": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32, int32}, []*wasmtime.ValType{int32}), dispatcher.Call),
-		"opa_builtin1": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32, int32, int32}, []*wasmtime.ValType{int32}), dispatcher.Call),
-		"opa_builtin2": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32, int32, int32, int32}, []*wasmtime.ValType{int32}), dispatcher.Call),
-		"opa_builtin3": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32, int32, int32, int32, int32}, []*wasmtime.ValType{int32}), dispatcher.Call),
-		"opa_builtin4": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32, int32, int32, int32, int32, int32}, []*wasmtime.ValType{int32}), dispatcher.Call),
-		"opa_println":  wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{int32}, nil), opaPrintln),
+		"opa_abort":    wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), opaAbort),
+		"opa_builtin0": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
+		"opa_builtin1": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
+		"opa_builtin2": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
+		"opa_builtin3": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
+		"opa_builtin4": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
+		"opa_println":  wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), opaPrintln),
 	}
-	return externs
-	env, _ := wazero.NewRuntime().NewModuleBuilder("env").
-		ExportFunction("opa_abort", opaAbort).
-		ExportFunction("opa_builtin0", func(i, j int32) int32 { return i }).
-		ExportFunction("opa_builtin1", func(i, j, k int32) int32 { return i }).
-		ExportFunction("opa_builtin2", func(i, j, k, l int32) int32 { return i }).
-		ExportFunction("opa_builtin3", func(i, j, k, l, m int32) int32 { return i }).
-		ExportFunction("opa_builtin4", func(i, j, k, l, m, n int32) int32 { return i }).
-		ExportFunction("opaPrintln", opaPrintln).
-		Instantiate(ctx, r)
 
+	return externs
 }
 
-func opaAbort(i int64) {
+func opaAbort(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+
+	data := caller.GetExport("memory").Memory().UnsafeData(caller)[args[0].I32():]
 
-	panic(abortError{message: string(i)})
+	n := bytes.IndexByte(data, 0)
+	if n == -1 {
+		panic("invalid abort argument")
+	}
+
+	panic(abortError{message: string(data[:n])})
 }
 
-func opaPrintln(i int32) {
+func opaPrintln(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	data := caller.GetExport("memory").Memory().UnsafeData(caller)[args[0].I32():]
 
-	fmt.Fprintln(os.Stderr, string(i))
+	n := bytes.IndexByte(data, 0)
+	if n == -1 {
+		panic("invalid opa_println argument")
+	}
 
+	fmt.Fprintln(os.Stderr, string(data[:n]))
+	return nil, nil
 }
 
 type builtinDispatcher struct {
@@ -160,7 +165,7 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 	// first two args are the built-in identifier and context structure
 	for i := 2; i < len(args); i++ {
 
-		x, err := fromWasmValue(caller, exports, args[i].int32())
+		x, err := fromWasmValue(caller, exports, args[i].I32())
 		if err != nil {
 			panic(builtinError{err: err})
 		}
@@ -170,7 +175,7 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 
 	var output *ast.Term
 
-	err := d.builtins[args[0].int32()](*d.ctx, convertedArgs, func(t *ast.Term) error {
+	err := d.builtins[args[0].I32()](*d.ctx, convertedArgs, func(t *ast.Term) error {
 		output = t
 		return nil
 	})
@@ -188,7 +193,7 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 
 	// if output is undefined, return NULL
 	if output == nil {
-		return []wasmtime.Val{wasmtime.Valint32(0)}, nil
+		return []wasmtime.Val{wasmtime.ValI32(0)}, nil
 	}
 
 	addr, err := toWasmValue(caller, exports, output)
@@ -196,7 +201,7 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 		panic(builtinError{err: err})
 	}
 
-	return []wasmtime.Val{wasmtime.Valint32(addr)}, nil
+	return []wasmtime.Val{wasmtime.ValI32(addr)}, nil
 }
 
 type exports struct {
@@ -17,11 +17,11 @@ import (
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/internal/wasm"
-	wasm_util "github.com/open-policy-agent/opa/internal/wasm/util"
 	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/util"
+	"wasmTest.skyefall.app/OPAwasm/internal/wasm"
+	wasm_util "wasmTest.skyefall.app/OPAwasm/wasm/util"
 )
 
 func TestOpaEvalGrowMemoryForLargeInput(t *testing.T) {
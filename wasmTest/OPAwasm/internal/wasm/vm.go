@@ -21,8 +21,6 @@ import (
 	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/topdown/cache"
 	"github.com/open-policy-agent/opa/topdown/print"
-	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/api"
 	sdk_errors "wasmTest.skyefall.app/OPAwasm/opa/errors"
 	"wasmTest.skyefall.app/OPAwasm/wasm/util"
 )
@@ -30,11 +28,13 @@ import (
 // VM is a wrapper around a Wasm VM instance
 type VM struct {
 	dispatcher           *builtinDispatcher
-	store                *wazero.Runtime
+	engine               *wasmtime.Engine
+	store                *wasmtime.Store
+	instance             *wasmtime.Instance // Pointer to avoid unintented destruction (triggering finalizers within).
 	policy               []byte
 	abiMajorVersion      int32
 	abiMinorVersion      int32
-	memory               *api.Memory
+	memory               *wasmtime.Memory
 	memoryMin            uint32
 	memoryMax            uint32
 	entrypointIDs        map[string]int32
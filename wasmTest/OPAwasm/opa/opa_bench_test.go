@@ -11,10 +11,10 @@ import (
 	"fmt"
 	"testing"
 
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
-	"github.com/open-policy-agent/opa/internal/wasm/util"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util/test"
+	"wasmTest.skyefall.app/OPAwasm/opa"
+	"wasmTest.skyefall.app/OPAwasm/wasm/util"
 )
 
 func BenchmarkWasmRego(b *testing.B) {
@@ -17,10 +17,10 @@ import (
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
-	wasm_util "github.com/open-policy-agent/opa/internal/wasm/util"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util"
+	"wasmTest.skyefall.app/OPAwasm/opa"
+	wasm_util "wasmTest.skyefall.app/OPAwasm/wasm/util"
 )
 
 // control dumping in this file
@@ -21,11 +21,11 @@ import (
 	"time"
 
 	"github.com/open-policy-agent/opa/ast"
-	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/test/cases"
 	"github.com/open-policy-agent/opa/types"
 	"github.com/open-policy-agent/opa/util"
+	"wasmTest.skyefall.app/OPAwasm/opa"
 )
 
 const opaRootDir = "../../../../../"
@@ -5,7 +5,7 @@ go 1.18
 require (
 	github.com/OneOfOne/xxhash v1.2.8 // indirect
 	github.com/agnivade/levenshtein v1.0.1 // indirect
-	github.com/bytecodealliance/wasmtime-go v0.36.0 // indirect
+	github.com/bytecodealliance/wasmtime-go v0.36.0
 	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/gobwas/glob v0.2.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -89,5 +89,5 @@ require (
 
 require (
 	github.com/open-policy-agent/opa v0.41.0
-	github.com/tetratelabs/wazero v0.0.0-20220606011721-119b069ba23e // indirect
+	github.com/tetratelabs/wazero v0.0.0-20220606011721-119b069ba23e
 )